@@ -20,33 +20,89 @@ import (
 	"fmt"
 )
 
-// AVLTree is a self-balancing binary search tree.
-type AVLTree struct {
-	Root *Node // Teh root of the AVL tree.
+// Tree is a self-balancing binary search tree ordering keys of type K with a user comparator.
+// Create it with NewTree, the zero value Tree can only hold []byte keys.
+type Tree[K, V any] struct {
+	Root    *TreeNode[K, V]  // Teh root of the AVL tree.
+	compare func(a, b K) int // The function ordering the keys of the AVL tree.
+	gen     uint64           // The generation of the nodes the AVL tree may modify in place.
 }
 
-// Node represents a node in the AVL tree.
-type Node struct {
-	Key    []byte // The key of the node.
-	Value  []byte // The value of the node.
-	Left   *Node  // The left child of the node.
-	Right  *Node  // The right child of the node.
-	Height int    // The height of the node.
+// TreeNode represents a node in the AVL tree.
+type TreeNode[K, V any] struct {
+	Key    K               // The key of the node.
+	Value  V               // The value of the node.
+	Left   *TreeNode[K, V] // The left child of the node.
+	Right  *TreeNode[K, V] // The right child of the node.
+	Height int             // The height of the node.
+	Size   int             // The number of nodes in the subtree rooted at the node.
+	gen    uint64          // The generation of the tree which created the node.
 }
 
-// NewAVLTree creates a new AVL tree.
+// AVLTree is an AVL tree of byte slice keys and values.
+type AVLTree = Tree[[]byte, []byte]
+
+// Node represents a node in an AVLTree.
+type Node = TreeNode[[]byte, []byte]
+
+// NewTree creates a new AVL tree ordering keys with the provided compare function.
+// compare must return a negative number, zero or a positive number when a is less than, equal to or greater than b.
+// NewTree panics if compare is nil.
+func NewTree[K, V any](compare func(a, b K) int) *Tree[K, V] {
+	if compare == nil {
+		panic("avl: NewTree requires a compare function")
+	}
+
+	return &Tree[K, V]{compare: compare}
+}
+
+// NewAVLTree creates a new AVL tree ordering keys with bytes.Compare.
 func NewAVLTree() *AVLTree {
-	return &AVLTree{}
+	return NewTree[[]byte, []byte](bytes.Compare)
+}
+
+// NewAVLTreeWithComparator creates a new AVL tree ordering keys with the provided compare function.
+// compare must return a negative number, zero or a positive number when a is less than, equal to or greater than b.
+func NewAVLTreeWithComparator(compare func(a, b []byte) int) *AVLTree {
+	return NewTree[[]byte, []byte](compare)
+}
+
+// cmp compares two keys with the compare function of the AVL tree.
+// The zero value Tree has no compare function and orders []byte keys with bytes.Compare, it panics for any other type of key.
+func (t *Tree[K, V]) cmp(a, b K) int {
+	if t.compare == nil {
+		x, ok := any(a).([]byte)
+		if !ok {
+			panic(fmt.Sprintf("avl: zero value Tree cannot order %T keys, create it with NewTree", a))
+		}
+
+		return bytes.Compare(x, any(b).([]byte))
+	}
+	return t.compare(a, b)
 }
 
 // height returns the height of the node.
-func height(node *Node) int {
+func height[K, V any](node *TreeNode[K, V]) int {
 	if node == nil {
 		return 0
 	}
 	return node.Height
 }
 
+// size returns the number of nodes in the subtree rooted at the node.
+func size[K, V any](node *TreeNode[K, V]) int {
+	if node == nil {
+		return 0
+	}
+	return node.Size
+}
+
+// update recomputes the height and subtree size of the node from its children.
+func update[K, V any](node *TreeNode[K, V]) {
+	node.Height = max(height(node.Left), height(node.Right)) + 1
+	node.Size = size(node.Left) + size(node.Right) + 1
+}
+
 // max returns the maximum of two integers.
 func max(a, b int) int {
 	if a > b {
@@ -56,35 +112,37 @@ func max(a, b int) int {
 }
 
 // rightRotate rotates the node to the right.
-func rightRotate(y *Node) *Node {
-	x := y.Left
+func (t *Tree[K, V]) rightRotate(y *TreeNode[K, V]) *TreeNode[K, V] {
+	y = t.own(y)
+	x := t.own(y.Left)
 	T2 := x.Right
 
 	x.Right = y
 	y.Left = T2
 
-	y.Height = max(height(y.Left), height(y.Right)) + 1
-	x.Height = max(height(x.Left), height(x.Right)) + 1
+	update(y)
+	update(x)
 
 	return x
 }
 
 // leftRotate rotates the node to the left.
-func leftRotate(x *Node) *Node {
-	y := x.Right
+func (t *Tree[K, V]) leftRotate(x *TreeNode[K, V]) *TreeNode[K, V] {
+	x = t.own(x)
+	y := t.own(x.Right)
 	T2 := y.Left
 
 	y.Left = x
 	x.Right = T2
 
-	x.Height = max(height(x.Left), height(x.Right)) + 1
-	y.Height = max(height(y.Left), height(y.Right)) + 1
+	update(x)
+	update(y)
 
 	return y
 }
 
 // getBalance returns the balance factor of the node.
-func getBalance(N *Node) int {
+func getBalance[K, V any](N *TreeNode[K, V]) int {
 	if N == nil {
 		return 0
 	}
@@ -92,20 +150,22 @@ func getBalance(N *Node) int {
 }
 
 // Insert inserts a node with the given key and value into the AVL tree.
-func (t *AVLTree) Insert(key, val []byte) {
+func (t *Tree[K, V]) Insert(key K, val V) {
 	t.Root = t.insert(t.Root, key, val) // Update the root after insertion
 }
 
 // insert inserts a node with the given key and value into the AVL tree.
-func (t *AVLTree) insert(node *Node, key, val []byte) *Node {
+func (t *Tree[K, V]) insert(node *TreeNode[K, V], key K, val V) *TreeNode[K, V] {
 	if node == nil {
-		return &Node{Key: key, Height: 1, Value: val}
+		return &TreeNode[K, V]{Key: key, Height: 1, Size: 1, Value: val, gen: t.gen}
 	}
 
+	node = t.own(node)
+
 	// Compare keys (assuming K is unique)
-	if bytes.Compare(key, node.Key) < 0 {
+	if t.cmp(key, node.Key) < 0 {
 		node.Left = t.insert(node.Left, key, val)
-	} else if bytes.Compare(key, node.Key) > 0 {
+	} else if t.cmp(key, node.Key) > 0 {
 		node.Right = t.insert(node.Right, key, val)
 	} else {
 		// Duplicate key, replace the value
@@ -113,51 +173,142 @@ func (t *AVLTree) insert(node *Node, key, val []byte) *Node {
 		return node
 	}
 
-	node.Height = 1 + max(height(node.Left), height(node.Right))
+	update(node)
 
 	balance := getBalance(node)
 
-	if balance > 1 && bytes.Compare(key, node.Left.Key) < 0 {
-		return rightRotate(node)
+	if balance > 1 && t.cmp(key, node.Left.Key) < 0 {
+		return t.rightRotate(node)
 	}
-	if balance < -1 && bytes.Compare(key, node.Right.Key) > 0 {
-		return leftRotate(node)
+	if balance < -1 && t.cmp(key, node.Right.Key) > 0 {
+		return t.leftRotate(node)
 	}
-	if balance > 1 && bytes.Compare(key, node.Left.Key) > 0 {
-		node.Left = leftRotate(node.Left)
-		return rightRotate(node)
+	if balance > 1 && t.cmp(key, node.Left.Key) > 0 {
+		node.Left = t.leftRotate(node.Left)
+		return t.rightRotate(node)
 	}
-	if balance < -1 && bytes.Compare(key, node.Right.Key) < 0 {
-		node.Right = rightRotate(node.Right)
-		return leftRotate(node)
+	if balance < -1 && t.cmp(key, node.Right.Key) < 0 {
+		node.Right = t.rightRotate(node.Right)
+		return t.leftRotate(node)
 	}
 
 	return node
 }
 
 // Search searches for a node with the given key in the AVL tree.
-func (t *AVLTree) Search(key []byte) *Node {
+func (t *Tree[K, V]) Search(key K) *TreeNode[K, V] {
 	return t.search(t.Root, key)
 }
 
 // search searches for a node with the given key in the AVL tree.
-func (t *AVLTree) search(node *Node, key []byte) *Node {
-	if node == nil || bytes.Compare(node.Key, key) == 0 {
+func (t *Tree[K, V]) search(node *TreeNode[K, V], key K) *TreeNode[K, V] {
+	if node == nil || t.cmp(node.Key, key) == 0 {
 		return node
 	}
-	if bytes.Compare(key, node.Key) < 0 {
+	if t.cmp(key, node.Key) < 0 {
 		return t.search(node.Left, key)
 	}
 	return t.search(node.Right, key)
 }
 
+// Floor returns the node with the largest key less than or equal to key, or nil if there is none.
+func (t *Tree[K, V]) Floor(key K) *TreeNode[K, V] {
+	var floor *TreeNode[K, V]
+
+	for node := t.Root; node != nil; {
+		c := t.cmp(node.Key, key)
+		if c == 0 {
+			return node
+		}
+
+		if c < 0 {
+			floor = node
+			node = node.Right
+		} else {
+			node = node.Left
+		}
+	}
+
+	return floor
+}
+
+// Ceiling returns the node with the smallest key greater than or equal to key, or nil if there is none.
+func (t *Tree[K, V]) Ceiling(key K) *TreeNode[K, V] {
+	var ceiling *TreeNode[K, V]
+
+	for node := t.Root; node != nil; {
+		c := t.cmp(node.Key, key)
+		if c == 0 {
+			return node
+		}
+
+		if c > 0 {
+			ceiling = node
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+
+	return ceiling
+}
+
+// Predecessor returns the node with the largest key strictly less than key, or nil if there is none.
+// key does not have to be in the AVL tree.
+func (t *Tree[K, V]) Predecessor(key K) *TreeNode[K, V] {
+	var predecessor *TreeNode[K, V]
+
+	for node := t.Root; node != nil; {
+		if t.cmp(node.Key, key) < 0 {
+			predecessor = node
+			node = node.Right
+		} else {
+			node = node.Left
+		}
+	}
+
+	return predecessor
+}
+
+// Successor returns the node with the smallest key strictly greater than key, or nil if there is none.
+// key does not have to be in the AVL tree.
+func (t *Tree[K, V]) Successor(key K) *TreeNode[K, V] {
+	var successor *TreeNode[K, V]
+
+	for node := t.Root; node != nil; {
+		if t.cmp(node.Key, key) > 0 {
+			successor = node
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+
+	return successor
+}
+
+// Min returns the node with the smallest key, or nil if the AVL tree is empty.
+func (t *Tree[K, V]) Min() *TreeNode[K, V] {
+	node := t.Root
+	for node != nil && node.Left != nil {
+		node = node.Left
+	}
+
+	return node
+}
+
+// Max returns the node with the largest key, or nil if the AVL tree is empty.
+func (t *Tree[K, V]) Max() *TreeNode[K, V] {
+	return t.getMaxNode(t.Root)
+}
+
 // InOrderTraversal traverses the AVL tree in-order.
-func (t *AVLTree) InOrderTraversal(f func(*Node)) {
+func (t *Tree[K, V]) InOrderTraversal(f func(*TreeNode[K, V])) {
 	t.inOrderTraversal(t.Root, f)
 }
 
 // inOrderTraversal traverses the AVL tree in-order.
-func (t *AVLTree) inOrderTraversal(node *Node, f func(*Node)) {
+func (t *Tree[K, V]) inOrderTraversal(node *TreeNode[K, V], f func(*TreeNode[K, V])) {
 	if node != nil {
 		t.inOrderTraversal(node.Left, f)
 		f(node)
@@ -166,19 +317,27 @@ func (t *AVLTree) inOrderTraversal(node *Node, f func(*Node)) {
 }
 
 // Print prints the AVL tree in-order. (for debugging)
-func (t *AVLTree) Print(node *Node) {
+func (t *Tree[K, V]) Print(node *TreeNode[K, V]) {
 	if node != nil {
 		t.Print(node.Left)
-		fmt.Printf("%s: %v ", string(node.Key), node.Value)
+		fmt.Printf("%v: %v ", printable(node.Key), node.Value)
 		t.Print(node.Right)
 	}
 }
 
+// printable returns a []byte key as a string so it prints readably.
+func printable(key any) any {
+	if b, ok := key.([]byte); ok {
+		return string(b)
+	}
+	return key
+}
+
 // GetInOrderKeys returns the keys of the AVL tree in-order.
-func (t *AVLTree) GetInOrderKeys() ([][]byte, [][]byte) {
-	var keys [][]byte
-	var values [][]byte
-	t.inOrderTraversal(t.Root, func(node *Node) {
+func (t *Tree[K, V]) GetInOrderKeys() ([]K, []V) {
+	var keys []K
+	var values []V
+	t.inOrderTraversal(t.Root, func(node *TreeNode[K, V]) {
 		keys = append(keys, node.Key)
 		values = append(values, node.Value)
 	})
@@ -195,65 +354,69 @@ func BuildAVLFromKeys(keys [][]byte, values [][]byte) *AVLTree {
 }
 
 // Delete deletes the node with the given key from the AVL tree.
-func (t *AVLTree) Delete(key []byte) {
+func (t *Tree[K, V]) Delete(key K) {
 	t.Root = t.delete(t.Root, key)
 }
 
 // delete deletes the node with the given key from the AVL tree.
-func (t *AVLTree) delete(node *Node, key []byte) *Node {
+func (t *Tree[K, V]) delete(node *TreeNode[K, V], key K) *TreeNode[K, V] {
 	if node == nil {
 		return node
 	}
 
 	// Compare keys
-	if bytes.Compare(key, node.Key) < 0 {
-		node.Left = t.delete(node.Left, key)
-	} else if bytes.Compare(key, node.Key) > 0 {
-		node.Right = t.delete(node.Right, key)
-	} else {
+	if t.cmp(key, node.Key) == 0 && (node.Left == nil || node.Right == nil) {
 		// Node with only one child or no child
 		if node.Left == nil {
 			return node.Right
-		} else if node.Right == nil {
-			return node.Left
 		}
+		return node.Left
+	}
 
+	node = t.own(node)
+
+	if t.cmp(key, node.Key) < 0 {
+		node.Left = t.delete(node.Left, key)
+	} else if t.cmp(key, node.Key) > 0 {
+		node.Right = t.delete(node.Right, key)
+	} else {
 		// Node with two children, get the in-order predecessor (maximum in the left subtree)
 		maxNode := t.getMaxNode(node.Left)
 		node.Key = maxNode.Key
+		node.Value = maxNode.Value
 		node.Left = t.delete(node.Left, maxNode.Key)
 	}
 
-	// Update height of the current node
-	node.Height = 1 + max(height(node.Left), height(node.Right))
+	// Update height and size of the current node
+	update(node)
 
 	// Rebalance the tree
 	balance := getBalance(node)
 
 	// Left Left Case
 	if balance > 1 && getBalance(node.Left) >= 0 {
-		return rightRotate(node)
+		return t.rightRotate(node)
 	}
 	// Left Right Case
 	if balance > 1 && getBalance(node.Left) < 0 {
-		node.Left = leftRotate(node.Left)
-		return rightRotate(node)
+		node.Left = t.leftRotate(node.Left)
+		return t.rightRotate(node)
 	}
 	// Right Right Case
 	if balance < -1 && getBalance(node.Right) <= 0 {
-		return leftRotate(node)
+		return t.leftRotate(node)
 	}
 	// Right Left Case
 	if balance < -1 && getBalance(node.Right) > 0 {
-		node.Right = rightRotate(node.Right)
-		return leftRotate(node)
+		node.Right = t.rightRotate(node.Right)
+		return t.leftRotate(node)
 	}
 
 	return node
 }
 
 // getMaxNode returns the node with the maximum key in the subtree rooted at node.
-func (t *AVLTree) getMaxNode(node *Node) *Node {
+func (t *Tree[K, V]) getMaxNode(node *TreeNode[K, V]) *TreeNode[K, V] {
 	if node == nil || node.Right == nil {
 		return node
 	}
@@ -261,22 +424,63 @@ func (t *AVLTree) getMaxNode(node *Node) *Node {
 }
 
 // GetSize returns the number of nodes in the AVL tree.
-func (t *AVLTree) GetSize() int {
-	return t.getSize(t.Root)
+func (t *Tree[K, V]) GetSize() int {
+	return t.Size()
 }
 
-// getSize returns the number of nodes in the subtree rooted at node.
-func (t *AVLTree) getSize(node *Node) int {
-	if node == nil {
-		return 0
+// Size returns the number of nodes in the AVL tree in O(1), every node keeps the size of its subtree.
+func (t *Tree[K, V]) Size() int {
+	return size(t.Root)
+}
+
+// Rank returns the number of keys less than key, which is the index of key in order if it is in the AVL tree.
+func (t *Tree[K, V]) Rank(key K) int {
+	rank := 0
+
+	for node := t.Root; node != nil; {
+		c := t.cmp(key, node.Key)
+		if c == 0 {
+			return rank + size(node.Left)
+		}
+
+		if c < 0 {
+			node = node.Left
+		} else {
+			rank += size(node.Left) + 1
+			node = node.Right
+		}
 	}
-	return 1 + t.getSize(node.Left) + t.getSize(node.Right)
+
+	return rank
+}
+
+// Select returns the node with the i-th smallest key, counting from 0, or nil if i is out of range.
+func (t *Tree[K, V]) Select(i int) *TreeNode[K, V] {
+	if i < 0 {
+		return nil
+	}
+
+	for node := t.Root; node != nil; {
+		left := size(node.Left)
+		if i == left {
+			return node
+		}
+
+		if i < left {
+			node = node.Left
+		} else {
+			i -= left + 1
+			node = node.Right
+		}
+	}
+
+	return nil
 }
 
 // InOrderKeys returns the keys of the AVL tree in-order.
-func (t *AVLTree) InOrderKeys() [][]byte {
-	var keys [][]byte
-	t.InOrderTraversal(func(node *Node) {
+func (t *Tree[K, V]) InOrderKeys() []K {
+	var keys []K
+	t.InOrderTraversal(func(node *TreeNode[K, V]) {
 		keys = append(keys, node.Key)
 	})
 	return keys
@@ -17,6 +17,8 @@ package avl
 
 import (
 	"bytes"
+	"cmp"
+	"fmt"
 	"testing"
 )
 
@@ -119,3 +121,584 @@ func TestAVLTree_GetInOrderKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestAVLTree_DeleteKeepsValues(t *testing.T) {
+	tree := NewAVLTree()
+	for _, key := range []string{"d", "b", "f", "a", "c", "e", "g"} {
+		tree.Insert([]byte(key), []byte("value-"+key))
+	}
+
+	// d has two children so it is replaced by its in-order predecessor
+	tree.Delete([]byte("d"))
+
+	for _, key := range []string{"a", "b", "c", "e", "f", "g"} {
+		node := tree.Search([]byte(key))
+		if node == nil || string(node.Value) != "value-"+key {
+			t.Fatalf("expected value-%s for key %s", key, key)
+		}
+	}
+}
+
+func TestAVLTree_Comparator(t *testing.T) {
+	tree := NewAVLTreeWithComparator(func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	})
+
+	for _, key := range []string{"b", "d", "a", "c"} {
+		tree.Insert([]byte(key), []byte(key))
+	}
+
+	keys := tree.InOrderKeys()
+	expected := []string{"d", "c", "b", "a"}
+	for i, key := range keys {
+		if string(key) != expected[i] {
+			t.Fatalf("expected %s at %d, got %s", expected[i], i, key)
+		}
+	}
+
+	tree.Delete([]byte("c"))
+	if tree.Search([]byte("c")) != nil {
+		t.Fatal("expected c to be deleted")
+	}
+
+	if node := tree.Search([]byte("a")); node == nil || string(node.Value) != "a" {
+		t.Fatal("expected to find a")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	tree := NewAVLTree()
+
+	// Even keys from 000 to 198
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i*2))
+		tree.Insert(key, key)
+	}
+
+	it := tree.Iterator()
+	if it.Valid() {
+		t.Fatal("expected an unpositioned iterator not to be valid")
+	}
+
+	it.SeekToFirst()
+	for i := 0; i < 100; i++ {
+		if !it.Valid() || string(it.Key()) != fmt.Sprintf("%03d", i*2) {
+			t.Fatalf("expected %03d", i*2)
+		}
+
+		it.Next()
+	}
+
+	if it.Valid() {
+		t.Fatal("expected the iterator to be exhausted")
+	}
+
+	it.SeekToLast()
+	for i := 99; i >= 0; i-- {
+		if !it.Valid() || string(it.Value()) != fmt.Sprintf("%03d", i*2) {
+			t.Fatalf("expected %03d", i*2)
+		}
+
+		it.Prev()
+	}
+
+	if it.Valid() {
+		t.Fatal("expected the iterator to be exhausted")
+	}
+}
+
+func TestIterator_Seek(t *testing.T) {
+	tree := NewAVLTree()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i*2))
+		tree.Insert(key, key)
+	}
+
+	it := tree.Iterator()
+
+	it.Seek([]byte("051"))
+	if !it.Valid() || string(it.Key()) != "052" {
+		t.Fatal("expected to seek to 052")
+	}
+
+	it.Seek([]byte("050"))
+	if !it.Valid() || string(it.Key()) != "050" {
+		t.Fatal("expected to seek to 050")
+	}
+
+	it.Prev()
+	if !it.Valid() || string(it.Key()) != "048" {
+		t.Fatal("expected 048 before 050")
+	}
+
+	it.Next()
+	it.Next()
+	if !it.Valid() || string(it.Key()) != "052" {
+		t.Fatal("expected 052 after 050")
+	}
+
+	it.Seek([]byte(""))
+	if !it.Valid() || string(it.Key()) != "000" {
+		t.Fatal("expected to seek to the first key")
+	}
+
+	it.Seek([]byte("199"))
+	if it.Valid() {
+		t.Fatal("expected nothing after 198")
+	}
+
+	// An empty tree
+	it = NewAVLTree().Iterator()
+	it.SeekToFirst()
+	if it.Valid() {
+		t.Fatal("expected an empty tree to have no keys")
+	}
+}
+
+// collectKeys runs the traversal and returns the keys it visited.
+func collectKeys(traverse func(fn NodeIterator)) []string {
+	var keys []string
+	traverse(func(node *Node) bool {
+		keys = append(keys, string(node.Key))
+		return true
+	})
+	return keys
+}
+
+func TestAVLTree_BoundedTraversals(t *testing.T) {
+	tree := NewAVLTree()
+
+	for i := 9; i >= 0; i-- {
+		key := []byte(fmt.Sprintf("%d", i))
+		tree.Insert(key, key)
+	}
+
+	tests := []struct {
+		name     string
+		traverse func(fn NodeIterator)
+		expected string
+	}{
+		{"Ascend", tree.Ascend, "[0 1 2 3 4 5 6 7 8 9]"},
+		{"AscendRange", func(fn NodeIterator) { tree.AscendRange([]byte("3"), []byte("7"), fn) }, "[3 4 5 6]"},
+		{"AscendGreaterOrEqual", func(fn NodeIterator) { tree.AscendGreaterOrEqual([]byte("7"), fn) }, "[7 8 9]"},
+		{"AscendLessThan", func(fn NodeIterator) { tree.AscendLessThan([]byte("3"), fn) }, "[0 1 2]"},
+		{"Descend", tree.Descend, "[9 8 7 6 5 4 3 2 1 0]"},
+		{"DescendRange", func(fn NodeIterator) { tree.DescendRange([]byte("7"), []byte("3"), fn) }, "[7 6 5 4]"},
+		{"DescendLessOrEqual", func(fn NodeIterator) { tree.DescendLessOrEqual([]byte("2"), fn) }, "[2 1 0]"},
+		{"DescendGreaterThan", func(fn NodeIterator) { tree.DescendGreaterThan([]byte("6"), fn) }, "[9 8 7]"},
+		{"Empty range", func(fn NodeIterator) { tree.AscendRange([]byte("5"), []byte("5"), fn) }, "[]"},
+	}
+
+	for _, test := range tests {
+		if keys := fmt.Sprint(collectKeys(test.traverse)); keys != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.name, test.expected, keys)
+		}
+	}
+}
+
+func TestAVLTree_TraversalStopsEarly(t *testing.T) {
+	tree := NewAVLTree()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		tree.Insert(key, key)
+	}
+
+	visited := 0
+	tree.AscendGreaterOrEqual([]byte("500"), func(node *Node) bool {
+		visited++
+		return visited < 3
+	})
+
+	if visited != 3 {
+		t.Fatalf("expected 3 nodes to be visited, got %d", visited)
+	}
+
+	visited = 0
+	tree.Descend(func(node *Node) bool {
+		visited++
+		return string(node.Key) != "990"
+	})
+
+	if visited != 10 {
+		t.Fatalf("expected 10 nodes to be visited, got %d", visited)
+	}
+}
+
+func TestAVLTree_NearestKeys(t *testing.T) {
+	tree := NewAVLTree()
+
+	if tree.Min() != nil || tree.Max() != nil || tree.Floor([]byte("1")) != nil {
+		t.Fatal("expected an empty tree to have no keys")
+	}
+
+	// Keys 10, 20, ... 90
+	for i := 1; i < 10; i++ {
+		key := []byte(fmt.Sprintf("%d0", i))
+		tree.Insert(key, key)
+	}
+
+	keyOf := func(node *Node) string {
+		if node == nil {
+			return "nil"
+		}
+		return string(node.Key)
+	}
+
+	tests := []struct {
+		name     string
+		node     *Node
+		expected string
+	}{
+		{"Min", tree.Min(), "10"},
+		{"Max", tree.Max(), "90"},
+		{"Floor between keys", tree.Floor([]byte("45")), "40"},
+		{"Floor of a key", tree.Floor([]byte("40")), "40"},
+		{"Floor below all keys", tree.Floor([]byte("05")), "nil"},
+		{"Ceiling between keys", tree.Ceiling([]byte("45")), "50"},
+		{"Ceiling of a key", tree.Ceiling([]byte("50")), "50"},
+		{"Ceiling above all keys", tree.Ceiling([]byte("95")), "nil"},
+		{"Predecessor of a key", tree.Predecessor([]byte("40")), "30"},
+		{"Predecessor between keys", tree.Predecessor([]byte("45")), "40"},
+		{"Predecessor of the first key", tree.Predecessor([]byte("10")), "nil"},
+		{"Successor of a key", tree.Successor([]byte("40")), "50"},
+		{"Successor between keys", tree.Successor([]byte("45")), "50"},
+		{"Successor of the last key", tree.Successor([]byte("90")), "nil"},
+	}
+
+	for _, test := range tests {
+		if key := keyOf(test.node); key != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.name, test.expected, key)
+		}
+	}
+}
+
+func TestIterator_SeekForPrev(t *testing.T) {
+	tree := NewAVLTree()
+
+	for i := 1; i < 10; i++ {
+		key := []byte(fmt.Sprintf("%d0", i))
+		tree.Insert(key, key)
+	}
+
+	it := tree.Iterator()
+
+	it.SeekForPrev([]byte("45"))
+	if !it.Valid() || string(it.Key()) != "40" {
+		t.Fatal("expected to seek to 40")
+	}
+
+	it.Prev()
+	if !it.Valid() || string(it.Key()) != "30" {
+		t.Fatal("expected 30 before 40")
+	}
+
+	it.SeekForPrev([]byte("99"))
+	if !it.Valid() || string(it.Key()) != "90" {
+		t.Fatal("expected to seek to 90")
+	}
+
+	it.SeekForPrev([]byte("05"))
+	if it.Valid() {
+		t.Fatal("expected nothing before 10")
+	}
+}
+
+// checkSizes verifies the subtree size of every node, returning the size of the subtree.
+func checkSizes[K, V any](t *testing.T, node *TreeNode[K, V]) int {
+	if node == nil {
+		return 0
+	}
+
+	size := checkSizes(t, node.Left) + checkSizes(t, node.Right) + 1
+	if node.Size != size {
+		t.Fatalf("expected node %v to have size %d, got %d", printable(node.Key), size, node.Size)
+	}
+
+	return size
+}
+
+func TestAVLTree_Size(t *testing.T) {
+	tree := NewAVLTree()
+
+	if tree.Size() != 0 {
+		t.Fatalf("expected an empty tree, got %d", tree.Size())
+	}
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("%03d", (i*7)%500))
+		tree.Insert(key, key)
+	}
+
+	// Duplicates do not change the size
+	tree.Insert([]byte("123"), []byte("value"))
+
+	if tree.Size() != 500 || tree.GetSize() != 500 {
+		t.Fatalf("expected 500 nodes, got %d", tree.Size())
+	}
+
+	checkSizes(t, tree.Root)
+
+	for i := 0; i < 500; i += 3 {
+		tree.Delete([]byte(fmt.Sprintf("%03d", i)))
+	}
+
+	// Deleting a missing key does not change the size
+	tree.Delete([]byte("999"))
+
+	if tree.Size() != 333 {
+		t.Fatalf("expected 333 nodes, got %d", tree.Size())
+	}
+
+	checkSizes(t, tree.Root)
+}
+
+func TestAVLTree_RankAndSelect(t *testing.T) {
+	tree := NewAVLTree()
+
+	// Even keys from 000 to 198
+	for i := 99; i >= 0; i-- {
+		key := []byte(fmt.Sprintf("%03d", i*2))
+		tree.Insert(key, key)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%03d", i*2)
+
+		if rank := tree.Rank([]byte(key)); rank != i {
+			t.Fatalf("expected %s to have rank %d, got %d", key, i, rank)
+		}
+
+		node := tree.Select(i)
+		if node == nil || string(node.Key) != key {
+			t.Fatalf("expected key %d to be %s", i, key)
+		}
+	}
+
+	// Missing keys rank where they would be
+	if rank := tree.Rank([]byte("051")); rank != 26 {
+		t.Fatalf("expected 051 to have rank 26, got %d", rank)
+	}
+
+	if rank := tree.Rank([]byte("999")); rank != 100 {
+		t.Fatalf("expected 999 to have rank 100, got %d", rank)
+	}
+
+	if tree.Select(-1) != nil || tree.Select(100) != nil {
+		t.Fatal("expected out of range selects to return nil")
+	}
+
+	// The number of keys in [050, 100)
+	if count := tree.Rank([]byte("100")) - tree.Rank([]byte("050")); count != 25 {
+		t.Fatalf("expected 25 keys in range, got %d", count)
+	}
+}
+
+func TestTree_Generic(t *testing.T) {
+	tree := NewTree[int, string](cmp.Compare[int])
+
+	for i := 99; i >= 0; i-- {
+		tree.Insert(i, fmt.Sprintf("value%d", i))
+	}
+
+	for i := 0; i < 100; i++ {
+		node := tree.Search(i)
+		if node == nil || node.Value != fmt.Sprintf("value%d", i) {
+			t.Fatalf("expected to find key %d", i)
+		}
+	}
+
+	for i := 0; i < 100; i += 2 {
+		tree.Delete(i)
+	}
+
+	if tree.Search(10) != nil {
+		t.Fatal("expected key 10 to be deleted")
+	}
+
+	checkSizes(t, tree.Root)
+
+	// The odd keys remain in order
+	it := tree.Iterator()
+	expected := 1
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if it.Key() != expected {
+			t.Fatalf("expected key %d, got %d", expected, it.Key())
+		}
+		expected += 2
+	}
+
+	if expected != 101 {
+		t.Fatalf("expected to iterate 50 keys, stopped at %d", expected)
+	}
+
+	var keys []int
+	tree.AscendRange(10, 20, func(node *TreeNode[int, string]) bool {
+		keys = append(keys, node.Key)
+		return true
+	})
+
+	if fmt.Sprint(keys) != "[11 13 15 17 19]" {
+		t.Fatalf("expected keys [11 13 15 17 19], got %v", keys)
+	}
+
+	if rank := tree.Rank(50); rank != 25 {
+		t.Fatalf("expected 50 to have rank 25, got %d", rank)
+	}
+}
+
+func TestTree_ZeroValue(t *testing.T) {
+	// The zero value orders []byte keys
+	var tree AVLTree
+	tree.Insert([]byte("b"), []byte("2"))
+	tree.Insert([]byte("a"), []byte("1"))
+
+	if node := tree.Min(); node == nil || string(node.Key) != "a" {
+		t.Fatal("expected a to be the smallest key")
+	}
+
+	expectPanic := func(name, message string, f func()) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				t.Fatalf("%s: expected a panic", name)
+			}
+
+			if fmt.Sprint(r) != message {
+				t.Fatalf("%s: expected panic %q, got %q", name, message, r)
+			}
+		}()
+
+		f()
+	}
+
+	// Other keys need a compare function
+	expectPanic("zero value", "avl: zero value Tree cannot order int keys, create it with NewTree", func() {
+		var tree Tree[int, int]
+		tree.Insert(1, 1)
+		tree.Insert(2, 2)
+	})
+
+	expectPanic("nil compare", "avl: NewTree requires a compare function", func() {
+		NewTree[int, int](nil)
+	})
+}
+
+func TestAVLTree_Snapshot(t *testing.T) {
+	tree := NewAVLTree()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		tree.Insert(key, key)
+	}
+
+	snapshot := tree.Snapshot()
+
+	// Overwrite, delete and insert keys in the tree
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		switch i % 3 {
+		case 0:
+			tree.Insert(key, []byte("new"))
+		case 1:
+			tree.Delete(key)
+		}
+	}
+
+	for i := 100; i < 150; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		tree.Insert(key, key)
+	}
+
+	// The snapshot still holds the keys as they were
+	if snapshot.Size() != 100 {
+		t.Fatalf("expected snapshot to have 100 keys, got %d", snapshot.Size())
+	}
+
+	checkSizes(t, snapshot.tree.Root)
+	checkSizes(t, tree.Root)
+
+	i := 0
+	snapshot.Ascend(func(node *Node) bool {
+		key := fmt.Sprintf("%03d", i)
+		if string(node.Key) != key || string(node.Value) != key {
+			t.Fatalf("expected snapshot key %s, got %s=%s", key, node.Key, node.Value)
+		}
+		i++
+		return true
+	})
+
+	if tree.Size() != 117 {
+		t.Fatalf("expected tree to have 117 keys, got %d", tree.Size())
+	}
+
+	if node := tree.Search([]byte("003")); node == nil || string(node.Value) != "new" {
+		t.Fatal("expected 003 to be overwritten in the tree")
+	}
+
+	if tree.Search([]byte("004")) != nil {
+		t.Fatal("expected 004 to be deleted from the tree")
+	}
+
+	// A new snapshot holds the tree as it is now, the first one is unaffected
+	current := tree.Snapshot()
+	tree.Delete([]byte("003"))
+	tree.Insert([]byte("005"), []byte("tree"))
+
+	if node := current.Search([]byte("003")); node == nil || string(node.Value) != "new" {
+		t.Fatal("expected 003 to remain in the second snapshot")
+	}
+
+	if current.Search([]byte("004")) != nil {
+		t.Fatal("expected 004 to be deleted from the second snapshot")
+	}
+
+	if node := current.Search([]byte("005")); node == nil || string(node.Value) != "005" {
+		t.Fatal("expected 005 to keep its value in the second snapshot")
+	}
+
+	if node := snapshot.Search([]byte("004")); node == nil || string(node.Value) != "004" {
+		t.Fatal("expected 004 to remain in the first snapshot")
+	}
+}
+
+func TestAVLTree_SnapshotConcurrentReads(t *testing.T) {
+	tree := NewTree[int, int](cmp.Compare[int])
+
+	for i := 0; i < 1000; i++ {
+		tree.Insert(i, i)
+	}
+
+	snapshot := tree.Snapshot()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			tree.Delete(i)
+			tree.Insert(i+1000, i)
+		}
+	}()
+
+	for n := 0; n < 10; n++ {
+		expected := 0
+		it := snapshot.Iterator()
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if it.Key() != expected {
+				t.Fatalf("expected key %d, got %d", expected, it.Key())
+			}
+			expected++
+		}
+
+		if expected != 1000 {
+			t.Fatalf("expected 1000 keys in the snapshot, got %d", expected)
+		}
+	}
+
+	<-done
+
+	if tree.Size() != 1000 || tree.Min().Key != 1000 {
+		t.Fatal("expected the tree to hold keys 1000 to 1999")
+	}
+}
@@ -0,0 +1,168 @@
+// Package avl
+// Ordered iterator over an AVL tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package avl
+
+// TreeIterator walks the keys of an AVL tree in order, in both directions.
+// It keeps the path from the root to the current node on an explicit stack, positioning it costs O(log n) and every step O(1) amortized.
+// An iterator is invalidated by inserting into or deleting from the tree.
+type TreeIterator[K, V any] struct {
+	tree  *Tree[K, V]       // The tree being iterated.
+	stack []*TreeNode[K, V] // The path from the root to the current node, the current node on top.
+}
+
+// Iterator walks the keys of an AVLTree in order.
+type Iterator = TreeIterator[[]byte, []byte]
+
+// Iterator returns an unpositioned iterator over the AVL tree, call one of the Seek methods before using it.
+func (t *Tree[K, V]) Iterator() *TreeIterator[K, V] {
+	return &TreeIterator[K, V]{tree: t}
+}
+
+// Valid returns whether the iterator is positioned at a node.
+func (it *TreeIterator[K, V]) Valid() bool {
+	return len(it.stack) > 0
+}
+
+// Node returns the node the iterator is positioned at.
+func (it *TreeIterator[K, V]) Node() *TreeNode[K, V] {
+	return it.stack[len(it.stack)-1]
+}
+
+// Key returns the key of the node the iterator is positioned at.
+func (it *TreeIterator[K, V]) Key() K {
+	return it.Node().Key
+}
+
+// Value returns the value of the node the iterator is positioned at.
+func (it *TreeIterator[K, V]) Value() V {
+	return it.Node().Value
+}
+
+// SeekToFirst positions the iterator at the smallest key.
+func (it *TreeIterator[K, V]) SeekToFirst() {
+	it.stack = it.stack[:0]
+	it.pushLeft(it.tree.Root)
+}
+
+// SeekToLast positions the iterator at the largest key.
+func (it *TreeIterator[K, V]) SeekToLast() {
+	it.stack = it.stack[:0]
+	it.pushRight(it.tree.Root)
+}
+
+// Seek positions the iterator at the first key greater or equal to key.
+// The iterator is not valid if every key is smaller.
+func (it *TreeIterator[K, V]) Seek(key K) {
+	it.stack = it.stack[:0]
+
+	found := -1
+	for node := it.tree.Root; node != nil; {
+		it.stack = append(it.stack, node)
+
+		c := it.tree.cmp(node.Key, key)
+		if c == 0 {
+			found = len(it.stack) - 1
+			break
+		}
+
+		if c > 0 {
+			// A candidate, a smaller one may be on the left
+			found = len(it.stack) - 1
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+
+	// The path to the candidate is a prefix of the path walked
+	it.stack = it.stack[:found+1]
+}
+
+// SeekForPrev positions the iterator at the last key less than or equal to key.
+// The iterator is not valid if every key is greater.
+func (it *TreeIterator[K, V]) SeekForPrev(key K) {
+	it.stack = it.stack[:0]
+
+	found := -1
+	for node := it.tree.Root; node != nil; {
+		it.stack = append(it.stack, node)
+
+		c := it.tree.cmp(node.Key, key)
+		if c == 0 {
+			found = len(it.stack) - 1
+			break
+		}
+
+		if c < 0 {
+			// A candidate, a larger one may be on the right
+			found = len(it.stack) - 1
+			node = node.Right
+		} else {
+			node = node.Left
+		}
+	}
+
+	it.stack = it.stack[:found+1]
+}
+
+// Next moves the iterator to the next key.
+func (it *TreeIterator[K, V]) Next() {
+	node := it.Node()
+
+	if node.Right != nil {
+		it.pushLeft(node.Right)
+		return
+	}
+
+	// Climb until we come up from a left child
+	it.stack = it.stack[:len(it.stack)-1]
+	for len(it.stack) > 0 && it.Node().Right == node {
+		node = it.Node()
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+}
+
+// Prev moves the iterator to the previous key.
+func (it *TreeIterator[K, V]) Prev() {
+	node := it.Node()
+
+	if node.Left != nil {
+		it.pushRight(node.Left)
+		return
+	}
+
+	// Climb until we come up from a right child
+	it.stack = it.stack[:len(it.stack)-1]
+	for len(it.stack) > 0 && it.Node().Left == node {
+		node = it.Node()
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+}
+
+// pushLeft pushes the node and its chain of left children.
+func (it *TreeIterator[K, V]) pushLeft(node *TreeNode[K, V]) {
+	for ; node != nil; node = node.Left {
+		it.stack = append(it.stack, node)
+	}
+}
+
+// pushRight pushes the node and its chain of right children.
+func (it *TreeIterator[K, V]) pushRight(node *TreeNode[K, V]) {
+	for ; node != nil; node = node.Right {
+		it.stack = append(it.stack, node)
+	}
+}
@@ -0,0 +1,112 @@
+// Package avl
+// Copy-on-write snapshots of an AVL tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package avl
+
+import "sync/atomic"
+
+// generations hands out the generation of every tree version, each one unique.
+var generations atomic.Uint64
+
+// TreeSnapshot is a read-only view of an AVL tree as it was when the snapshot was taken.
+// The nodes it returns are shared with the tree and must not be modified.
+type TreeSnapshot[K, V any] struct {
+	tree *Tree[K, V] // The version of the tree the snapshot holds, never written to
+}
+
+// Snapshot is a snapshot of an AVL tree of byte slice keys and values
+type Snapshot = TreeSnapshot[[]byte, []byte]
+
+// Snapshot returns a read-only view of the AVL tree in O(1), sharing its nodes with the tree.
+// The tree can be modified afterwards without affecting the snapshot, a node shared by both is copied along with its path to the root the first time the tree modifies it.
+// Readers can traverse a snapshot while the tree is being written to, taking the snapshot is a write to the tree.
+func (t *Tree[K, V]) Snapshot() *TreeSnapshot[K, V] {
+	// Both versions get a new generation, every existing node now belongs to an older one and is copied before it is modified
+	t.gen = generations.Add(1)
+
+	return &TreeSnapshot[K, V]{tree: &Tree[K, V]{Root: t.Root, compare: t.compare, gen: generations.Add(1)}}
+}
+
+// Search returns the node of the key, nil if the key is not in the snapshot
+func (s *TreeSnapshot[K, V]) Search(key K) *TreeNode[K, V] {
+	return s.tree.Search(key)
+}
+
+// Floor returns the node with the greatest key less than or equal to the key
+func (s *TreeSnapshot[K, V]) Floor(key K) *TreeNode[K, V] {
+	return s.tree.Floor(key)
+}
+
+// Ceiling returns the node with the smallest key greater than or equal to the key
+func (s *TreeSnapshot[K, V]) Ceiling(key K) *TreeNode[K, V] {
+	return s.tree.Ceiling(key)
+}
+
+// Min returns the node with the smallest key
+func (s *TreeSnapshot[K, V]) Min() *TreeNode[K, V] {
+	return s.tree.Min()
+}
+
+// Max returns the node with the greatest key
+func (s *TreeSnapshot[K, V]) Max() *TreeNode[K, V] {
+	return s.tree.Max()
+}
+
+// Size returns the number of keys in the snapshot
+func (s *TreeSnapshot[K, V]) Size() int {
+	return s.tree.Size()
+}
+
+// Rank returns the number of keys less than the key
+func (s *TreeSnapshot[K, V]) Rank(key K) int {
+	return s.tree.Rank(key)
+}
+
+// Select returns the node with the i-th smallest key, starting at 0
+func (s *TreeSnapshot[K, V]) Select(i int) *TreeNode[K, V] {
+	return s.tree.Select(i)
+}
+
+// Iterator returns an iterator over the snapshot
+func (s *TreeSnapshot[K, V]) Iterator() *TreeIterator[K, V] {
+	return s.tree.Iterator()
+}
+
+// Ascend calls fn for every node in ascending order until fn returns false
+func (s *TreeSnapshot[K, V]) Ascend(fn TreeNodeIterator[K, V]) {
+	s.tree.Ascend(fn)
+}
+
+// AscendGreaterOrEqual calls fn for every node with a key greater than or equal to the pivot in ascending order until fn returns false
+func (s *TreeSnapshot[K, V]) AscendGreaterOrEqual(pivot K, fn TreeNodeIterator[K, V]) {
+	s.tree.AscendGreaterOrEqual(pivot, fn)
+}
+
+// Descend calls fn for every node in descending order until fn returns false
+func (s *TreeSnapshot[K, V]) Descend(fn TreeNodeIterator[K, V]) {
+	s.tree.Descend(fn)
+}
+
+// own returns the node if it was created by this version of the AVL tree, otherwise a copy of the node which can be modified in place.
+func (t *Tree[K, V]) own(node *TreeNode[K, V]) *TreeNode[K, V] {
+	if node == nil || node.gen == t.gen {
+		return node
+	}
+
+	copied := *node
+	copied.gen = t.gen
+	return &copied
+}
@@ -0,0 +1,119 @@
+// Package avl
+// Bounded traversals of an AVL tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package avl
+
+// TreeNodeIterator is called with the nodes of a traversal, returning false stops the traversal.
+type TreeNodeIterator[K, V any] func(node *TreeNode[K, V]) bool
+
+// NodeIterator is called with the nodes of an AVLTree traversal.
+type NodeIterator = TreeNodeIterator[[]byte, []byte]
+
+// Ascend calls fn with every node in ascending order.
+func (t *Tree[K, V]) Ascend(fn TreeNodeIterator[K, V]) {
+	t.ascend(t.Root, nil, nil, fn)
+}
+
+// AscendRange calls fn with every node in the range [greaterOrEqual, lessThan) in ascending order.
+func (t *Tree[K, V]) AscendRange(greaterOrEqual, lessThan K, fn TreeNodeIterator[K, V]) {
+	t.ascend(t.Root, &greaterOrEqual, &lessThan, fn)
+}
+
+// AscendGreaterOrEqual calls fn with every node greater or equal to pivot in ascending order.
+func (t *Tree[K, V]) AscendGreaterOrEqual(pivot K, fn TreeNodeIterator[K, V]) {
+	t.ascend(t.Root, &pivot, nil, fn)
+}
+
+// AscendLessThan calls fn with every node less than pivot in ascending order.
+func (t *Tree[K, V]) AscendLessThan(pivot K, fn TreeNodeIterator[K, V]) {
+	t.ascend(t.Root, nil, &pivot, fn)
+}
+
+// Descend calls fn with every node in descending order.
+func (t *Tree[K, V]) Descend(fn TreeNodeIterator[K, V]) {
+	t.descend(t.Root, nil, nil, fn)
+}
+
+// DescendRange calls fn with every node in the range [lessOrEqual, greaterThan) in descending order.
+func (t *Tree[K, V]) DescendRange(lessOrEqual, greaterThan K, fn TreeNodeIterator[K, V]) {
+	t.descend(t.Root, &lessOrEqual, &greaterThan, fn)
+}
+
+// DescendLessOrEqual calls fn with every node less or equal to pivot in descending order.
+func (t *Tree[K, V]) DescendLessOrEqual(pivot K, fn TreeNodeIterator[K, V]) {
+	t.descend(t.Root, &pivot, nil, fn)
+}
+
+// DescendGreaterThan calls fn with every node greater than pivot in descending order.
+func (t *Tree[K, V]) DescendGreaterThan(pivot K, fn TreeNodeIterator[K, V]) {
+	t.descend(t.Root, nil, &pivot, fn)
+}
+
+// ascend visits the nodes of the subtree between start (inclusive) and end (exclusive) in ascending order, a nil bound being unbounded.
+// Subtrees outside of the bounds are not visited.  It returns false once fn stops the traversal.
+func (t *Tree[K, V]) ascend(node *TreeNode[K, V], start, end *K, fn TreeNodeIterator[K, V]) bool {
+	if node == nil {
+		return true
+	}
+
+	// The node and its left subtree are below the range
+	if start != nil && t.cmp(node.Key, *start) < 0 {
+		return t.ascend(node.Right, start, end, fn)
+	}
+
+	// The node and its right subtree are above the range
+	if end != nil && t.cmp(node.Key, *end) >= 0 {
+		return t.ascend(node.Left, start, end, fn)
+	}
+
+	if !t.ascend(node.Left, start, end, fn) {
+		return false
+	}
+
+	if !fn(node) {
+		return false
+	}
+
+	return t.ascend(node.Right, start, end, fn)
+}
+
+// descend visits the nodes of the subtree between start (inclusive) and end (exclusive) in descending order, a nil bound being unbounded.
+// Subtrees outside of the bounds are not visited.  It returns false once fn stops the traversal.
+func (t *Tree[K, V]) descend(node *TreeNode[K, V], start, end *K, fn TreeNodeIterator[K, V]) bool {
+	if node == nil {
+		return true
+	}
+
+	// The node and its right subtree are above the range
+	if start != nil && t.cmp(node.Key, *start) > 0 {
+		return t.descend(node.Left, start, end, fn)
+	}
+
+	// The node and its left subtree are below the range
+	if end != nil && t.cmp(node.Key, *end) <= 0 {
+		return t.descend(node.Right, start, end, fn)
+	}
+
+	if !t.descend(node.Right, start, end, fn) {
+		return false
+	}
+
+	if !fn(node) {
+		return false
+	}
+
+	return t.descend(node.Left, start, end, fn)
+}
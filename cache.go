@@ -0,0 +1,252 @@
+// Package lsmt
+// LRU page cache shared by pagers
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// pageCacheEntryOverhead is the memory a cached page takes besides its data.
+const pageCacheEntryOverhead = int64(unsafe.Sizeof(pageCacheEntry{})) + int64(unsafe.Sizeof(list.Element{}))
+
+const PAGE_CACHE_SHARDS = 16            // Number of shards pages are spread over, each with its own lock and LRU list
+const PAGE_CACHE_SHARD_SIZE = 512 << 10 // Smallest capacity of a shard, smaller caches have fewer shards
+
+// pageCacheFiles hands out the ids of the files of the pagers using a page cache.
+var pageCacheFiles atomic.Uint64
+
+// PageCache is a size-bounded LRU cache of pages read by pagers.
+// One page cache can be shared by many pagers, SSTables of one or more LSM-trees, pages are keyed by their file and page id.
+// Pages are spread over shards by key so that readers of different pages don't wait for each other, each shard evicting its least recently used pages.
+type PageCache struct {
+	capacity  int64            // The bytes the cached pages may take.
+	shards    []pageCacheShard // The shards the pages are spread over.
+	hits      atomic.Uint64    // Reads served from the cache.
+	misses    atomic.Uint64    // Reads which went to the file.
+	evictions atomic.Uint64    // Pages evicted to stay within the capacity.
+}
+
+// pageCacheShard is an LRU cache of a share of the pages of a page cache.
+type pageCacheShard struct {
+	lock     sync.Mutex                     // Lock for the cached pages of the shard.
+	capacity int64                          // The bytes the cached pages of the shard may take.
+	size     int64                          // The bytes the cached pages of the shard take.
+	entries  map[pageCacheKey]*list.Element // The cached pages by key.
+	lru      *list.List                     // The cached pages, the most recently used at the front.
+}
+
+// pageCacheKey identifies a page of a file.
+type pageCacheKey struct {
+	file   uint64 // The id of the file of the pager.
+	pageID int64  // The page.
+}
+
+// pageCacheEntry is a cached page.
+type pageCacheEntry struct {
+	key  pageCacheKey // The file and page id of the page.
+	data []byte       // The data of the page, overflow pages included.
+	pins int          // The number of pins, a pinned page is not evicted.
+}
+
+// PageCacheStats are statistics about a page cache.
+type PageCacheStats struct {
+	Hits      uint64 // Reads served from the cache.
+	Misses    uint64 // Reads which went to the file.
+	Evictions uint64 // Pages evicted to stay within the capacity.
+	Pages     int    // Pages in the cache.
+	Size      int64  // Bytes the cached pages take.
+}
+
+// NewPageCache creates a page cache of capacity bytes to share between pagers.
+func NewPageCache(capacity int64) *PageCache {
+	shards := int(min(max(capacity/PAGE_CACHE_SHARD_SIZE, 1), PAGE_CACHE_SHARDS))
+
+	c := &PageCache{capacity: capacity, shards: make([]pageCacheShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = pageCacheShard{capacity: capacity / int64(shards), entries: make(map[pageCacheKey]*list.Element), lru: list.New()}
+	}
+
+	return c
+}
+
+// Capacity returns the bytes the cached pages may take.
+func (c *PageCache) Capacity() int64 {
+	return c.capacity
+}
+
+// Stats returns statistics about the page cache.
+func (c *PageCache) Stats() PageCacheStats {
+	stats := PageCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Evictions: c.evictions.Load()}
+
+	for i := range c.shards {
+		shard := &c.shards[i]
+
+		shard.lock.Lock()
+		stats.Pages += shard.lru.Len()
+		stats.Size += shard.size
+		shard.lock.Unlock()
+	}
+
+	return stats
+}
+
+// shard returns the shard of a page, consecutive pages of a file going to different shards.
+func (c *PageCache) shard(key pageCacheKey) *pageCacheShard {
+	return &c.shards[(key.file*0x9e3779b97f4a7c15+uint64(key.pageID))%uint64(len(c.shards))]
+}
+
+// get returns the cached data of a page, marking it as the most recently used and pinning it if asked to.
+func (c *PageCache) get(key pageCacheKey, pin bool) ([]byte, bool) {
+	data, ok := c.lookup(key, pin)
+	if !ok {
+		c.missed(1)
+	}
+
+	return data, ok
+}
+
+// missed records reads which went to the file.
+func (c *PageCache) missed(n int) {
+	c.misses.Add(uint64(n))
+}
+
+// lookup returns the cached data of a page like get, leaving the miss to be recorded by the caller
+// it is used when the page may turn out not to be the first page of data, overflow pages are never cached
+func (c *PageCache) lookup(key pageCacheKey, pin bool) ([]byte, bool) {
+	shard := c.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	element, ok := shard.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	shard.lru.MoveToFront(element)
+
+	entry := element.Value.(*pageCacheEntry)
+	if pin {
+		entry.pins++
+	}
+
+	return entry.data, true
+}
+
+// put caches the data of a page, pinning it if asked to, and evicts the least recently used unpinned pages of its shard above the capacity.
+func (c *PageCache) put(key pageCacheKey, data []byte, pin bool) {
+	shard := c.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	element, ok := shard.entries[key]
+	if ok {
+		entry := element.Value.(*pageCacheEntry)
+		shard.size += int64(len(data)) - int64(len(entry.data))
+		entry.data = data
+		shard.lru.MoveToFront(element)
+	} else {
+		element = shard.lru.PushFront(&pageCacheEntry{key: key, data: data})
+		shard.entries[key] = element
+		shard.size += int64(len(data)) + pageCacheEntryOverhead
+	}
+
+	if pin {
+		element.Value.(*pageCacheEntry).pins++
+	}
+
+	c.evictions.Add(shard.evict())
+}
+
+// evict removes the least recently used unpinned pages until the cached pages fit the capacity of the shard, returning the number of pages removed.
+// the caller must hold the lock of the shard
+func (s *pageCacheShard) evict() uint64 {
+	var evicted uint64
+
+	for element := s.lru.Back(); element != nil && s.size > s.capacity; {
+		prev := element.Prev()
+
+		if element.Value.(*pageCacheEntry).pins == 0 {
+			s.remove(element)
+			evicted++
+		}
+
+		element = prev
+	}
+
+	return evicted
+}
+
+// remove removes a cached page.
+// the caller must hold the lock of the shard
+func (s *pageCacheShard) remove(element *list.Element) {
+	entry := s.lru.Remove(element).(*pageCacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= int64(len(entry.data)) + pageCacheEntryOverhead
+}
+
+// unpin releases a pin of a cached page, evicting pages above the capacity once the page is unpinned.
+func (c *PageCache) unpin(key pageCacheKey) {
+	shard := c.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	element, ok := shard.entries[key]
+	if !ok {
+		return
+	}
+
+	entry := element.Value.(*pageCacheEntry)
+	if entry.pins > 0 {
+		entry.pins--
+	}
+
+	c.evictions.Add(shard.evict())
+}
+
+// invalidate removes a page from the cache once it is rewritten or freed, pinned or not.
+func (c *PageCache) invalidate(key pageCacheKey) {
+	shard := c.shard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if element, ok := shard.entries[key]; ok {
+		shard.remove(element)
+	}
+}
+
+// invalidateFile removes every page of a file from the cache once its pager is closed.
+func (c *PageCache) invalidateFile(file uint64) {
+	for i := range c.shards {
+		shard := &c.shards[i]
+
+		shard.lock.Lock()
+		for key, element := range shard.entries {
+			if key.file == file {
+				shard.remove(element)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
@@ -0,0 +1,302 @@
+// Package lsmt tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestPageCache(t *testing.T) {
+	// Room for 3 pages of 100 bytes
+	cache := NewPageCache(3 * (100 + pageCacheEntryOverhead))
+
+	page := func(i int) []byte {
+		return []byte(fmt.Sprintf("%0100d", i))
+	}
+
+	for i := 0; i < 3; i++ {
+		cache.put(pageCacheKey{file: 1, pageID: int64(i)}, page(i), false)
+	}
+
+	// Page 0 becomes the most recently used
+	if _, ok := cache.get(pageCacheKey{file: 1, pageID: 0}, false); !ok {
+		t.Fatal("expected page 0 to be cached")
+	}
+
+	// Page 1 is the least recently used and evicted
+	cache.put(pageCacheKey{file: 1, pageID: 3}, page(3), false)
+
+	if _, ok := cache.get(pageCacheKey{file: 1, pageID: 1}, false); ok {
+		t.Fatal("expected page 1 to be evicted")
+	}
+
+	// Pages of other files are kept apart
+	if _, ok := cache.get(pageCacheKey{file: 2, pageID: 0}, false); ok {
+		t.Fatal("expected page 0 of file 2 not to be cached")
+	}
+
+	// A pinned page is not evicted
+	if _, ok := cache.get(pageCacheKey{file: 1, pageID: 2}, true); !ok {
+		t.Fatal("expected page 2 to be cached")
+	}
+
+	for i := 4; i < 8; i++ {
+		cache.put(pageCacheKey{file: 1, pageID: int64(i)}, page(i), false)
+	}
+
+	if _, ok := cache.get(pageCacheKey{file: 1, pageID: 2}, false); !ok {
+		t.Fatal("expected pinned page 2 to stay cached")
+	}
+
+	cache.unpin(pageCacheKey{file: 1, pageID: 2})
+	for i := 8; i < 11; i++ {
+		cache.put(pageCacheKey{file: 1, pageID: int64(i)}, page(i), false)
+	}
+
+	if _, ok := cache.get(pageCacheKey{file: 1, pageID: 2}, false); ok {
+		t.Fatal("expected unpinned page 2 to be evicted")
+	}
+
+	cache.invalidate(pageCacheKey{file: 1, pageID: 9})
+
+	if _, ok := cache.get(pageCacheKey{file: 1, pageID: 9}, false); ok {
+		t.Fatal("expected page 9 to be invalidated")
+	}
+
+	cache.invalidateFile(1)
+
+	stats := cache.Stats()
+	if stats.Pages != 0 || stats.Size != 0 {
+		t.Fatalf("expected an empty cache, got %d pages of %d bytes", stats.Pages, stats.Size)
+	}
+
+	if stats.Hits != 3 || stats.Misses != 4 || stats.Evictions != 8 {
+		t.Fatalf("expected 3 hits, 4 misses and 8 evictions, got %+v", stats)
+	}
+}
+
+func TestPageCache_Shards(t *testing.T) {
+	// A small cache keeps one LRU list, a larger one is sharded
+	if shards := len(NewPageCache(1 << 10).shards); shards != 1 {
+		t.Fatalf("expected 1 shard, got %d", shards)
+	}
+
+	cache := NewPageCache(PAGE_CACHE_SHARDS * PAGE_CACHE_SHARD_SIZE)
+	if len(cache.shards) != PAGE_CACHE_SHARDS {
+		t.Fatalf("expected %d shards, got %d", PAGE_CACHE_SHARDS, len(cache.shards))
+	}
+
+	// Consecutive pages are spread evenly over the shards
+	for i := 0; i < 2*PAGE_CACHE_SHARDS; i++ {
+		cache.put(pageCacheKey{file: 1, pageID: int64(i)}, []byte(fmt.Sprintf("page %d", i)), false)
+	}
+
+	for i := range cache.shards {
+		if pages := cache.shards[i].lru.Len(); pages != 2 {
+			t.Fatalf("expected 2 pages in shard %d, got %d", i, pages)
+		}
+	}
+
+	// Readers of the shards run concurrently
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 2*PAGE_CACHE_SHARDS; i++ {
+				data, ok := cache.get(pageCacheKey{file: 1, pageID: int64(i)}, false)
+				if !ok || string(data) != fmt.Sprintf("page %d", i) {
+					t.Errorf("expected page %d to be cached, got %q", i, data)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Hits != 8*2*PAGE_CACHE_SHARDS || stats.Misses != 0 || stats.Pages != 2*PAGE_CACHE_SHARDS {
+		t.Fatalf("expected %d hits and %d pages, got %+v", 8*2*PAGE_CACHE_SHARDS, 2*PAGE_CACHE_SHARDS, stats)
+	}
+}
+
+func TestPager_PageCache(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	cache := NewPageCache(1 << 20)
+	pager.SetPageCache(cache)
+
+	pageID, err := pager.Write([]byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		data, err := pager.GetPage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "Hello World" {
+			t.Fatalf("expected Hello World, got %q", data)
+		}
+	}
+
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("expected 2 hits and 1 miss, got %+v", stats)
+	}
+
+	// Rewriting the page invalidates it
+	err = pager.WriteTo(pageID, []byte("Rewritten"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := pager.GetPage(pageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "Rewritten" {
+		t.Fatalf("expected Rewritten, got %q", data)
+	}
+
+	// Freeing the page invalidates it
+	err = pager.DeletePage(pageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = pager.GetPage(pageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data != nil {
+		t.Fatalf("expected a deleted page to return nil, got %q", data)
+	}
+}
+
+func TestPager_ReadPagesPageCache(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	cache := NewPageCache(1 << 20)
+	pager.SetPageCache(cache)
+
+	// The large value overflows into the two pages after it
+	pageIDs, err := pager.WriteRun([][]byte{[]byte("Hello"), bytes.Repeat([]byte("0123456789"), 300), []byte("World")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := make([]int64, pager.PagesCount())
+	for i := range all {
+		all[i] = int64(i)
+	}
+
+	for round := 0; round < 2; round++ {
+		pages, err := pager.ReadPages(all)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(pages[pageIDs[0]]) != "Hello" || string(pages[pageIDs[2]]) != "World" {
+			t.Fatalf("unexpected pages %q %q", pages[pageIDs[0]], pages[pageIDs[2]])
+		}
+	}
+
+	// Overflow pages are not cached and don't count as misses
+	if stats := cache.Stats(); stats.Misses != 3 || stats.Hits != 3 || stats.Pages != 3 {
+		t.Fatalf("expected 3 misses, 3 hits and 3 pages, got %+v", stats)
+	}
+}
+
+func TestLSMT_PageCache(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	defer os.RemoveAll("test_lsm_tree2")
+
+	// Two LSM-trees share a page cache
+	cache := NewPageCache(1 << 20)
+
+	trees := make([]*LSMT, 2)
+	for i, directory := range []string{"test_lsm_tree", "test_lsm_tree2"} {
+		lsmt, err := Open(directory, WithMemtableFlushSize(10), WithPageCache(cache))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lsmt.Close()
+
+		for j := 0; j < 50; j++ {
+			err = lsmt.Put([]byte(fmt.Sprintf("key%02d", j)), []byte(fmt.Sprintf("value%d", j)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		trees[i] = lsmt
+	}
+
+	for n := 0; n < 2; n++ {
+		for _, lsmt := range trees {
+			value, err := lsmt.Get([]byte("key05"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(value) != "value5" {
+				t.Fatalf("expected value5, got %s", value)
+			}
+		}
+	}
+
+	stats := trees[0].PageCacheStats()
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("expected the second reads to hit the cache, got %+v", stats)
+	}
+
+	if stats != trees[1].PageCacheStats() {
+		t.Fatal("expected both LSM-trees to report the shared cache")
+	}
+
+	// An LSM-tree opened without a cache reports none
+	lsmt, err := Open("test_lsm_tree3", WithMemtableFlushSize(10), WithPageCacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test_lsm_tree3")
+	defer lsmt.Close()
+
+	if lsmt.PageCacheStats() != (PageCacheStats{}) {
+		t.Fatal("expected no page cache statistics")
+	}
+}
@@ -0,0 +1,168 @@
+// Package lsmt
+// Key comparators
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+const COMPARATOR_FILE = ".comparator" // File in the LSM-tree directory holding the name of the comparator
+
+// Comparator orders the keys of an LSM-tree.
+type Comparator interface {
+	// Compare returns a negative number, zero or a positive number when a is less than, equal to or greater than b.
+	Compare(a, b []byte) int
+
+	// Name identifies the ordering, it is persisted so an LSM-tree cannot be reopened with a different comparator.
+	Name() string
+}
+
+// BytewiseComparator orders keys lexicographically by their bytes, this is the default comparator.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+// ReverseBytewiseComparator orders keys in the reverse order of BytewiseComparator.
+var ReverseBytewiseComparator Comparator = reverseBytewiseComparator{}
+
+// NumericComparator orders keys lexicographically, except that runs of digits are compared by their numeric value.
+// For example "item2" is less than "item10".
+var NumericComparator Comparator = numericComparator{}
+
+// bytewiseComparator compares keys with bytes.Compare.
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return "lsmt.BytewiseComparator"
+}
+
+// reverseBytewiseComparator compares keys with bytes.Compare in reverse.
+type reverseBytewiseComparator struct{}
+
+func (reverseBytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (reverseBytewiseComparator) Name() string {
+	return "lsmt.ReverseBytewiseComparator"
+}
+
+// numericComparator compares keys with runs of digits compared by value.
+type numericComparator struct{}
+
+func (numericComparator) Compare(a, b []byte) int {
+	i, j := 0, 0
+
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			// Find the end of both runs of digits
+			endA, endB := i, j
+			for endA < len(a) && isDigit(a[endA]) {
+				endA++
+			}
+			for endB < len(b) && isDigit(b[endB]) {
+				endB++
+			}
+
+			runA, runB := bytes.TrimLeft(a[i:endA], "0"), bytes.TrimLeft(b[j:endB], "0")
+
+			// A longer number without leading zeros is larger
+			if len(runA) != len(runB) {
+				if len(runA) < len(runB) {
+					return -1
+				}
+				return 1
+			}
+
+			if c := bytes.Compare(runA, runB); c != 0 {
+				return c
+			}
+
+			// Equal numbers, the one with fewer leading zeros comes first so only equal keys compare as equal
+			if endA-i != endB-j {
+				if endA-i < endB-j {
+					return -1
+				}
+				return 1
+			}
+
+			i, j = endA, endB
+			continue
+		}
+
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+
+		i++
+		j++
+	}
+
+	switch {
+	case len(a)-i < len(b)-j:
+		return -1
+	case len(a)-i > len(b)-j:
+		return 1
+	}
+
+	return 0
+}
+
+func (numericComparator) Name() string {
+	return "lsmt.NumericComparator"
+}
+
+// isDigit returns whether the byte is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// checkComparator makes sure the LSM-tree in the directory was created with the comparator, recording its name if the directory has none yet.
+// Directories without a recorded comparator were created with BytewiseComparator.
+func checkComparator(directory string, comparator Comparator, isNew, readOnly bool) error {
+	fileName := directory + string(os.PathSeparator) + COMPARATOR_FILE
+
+	name, err := os.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		if string(name) != comparator.Name() {
+			return fmt.Errorf("lsm-tree was created with comparator %s, cannot open it with %s", string(name), comparator.Name())
+		}
+
+		return nil
+	}
+
+	if !isNew && comparator.Name() != BytewiseComparator.Name() {
+		return fmt.Errorf("lsm-tree was created with comparator %s, cannot open it with %s", BytewiseComparator.Name(), comparator.Name())
+	}
+
+	if readOnly {
+		return nil
+	}
+
+	return os.WriteFile(fileName, []byte(comparator.Name()), 0644)
+}
@@ -0,0 +1,142 @@
+// Package lsmt tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestComparator_Numeric(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"item2", "item10", -1},
+		{"item10", "item2", 1},
+		{"item10", "item10", 0},
+		{"item02", "item2", 1},
+		{"a1b2", "a1b10", -1},
+		{"item", "item1", -1},
+		{"b1", "a2", 1},
+	}
+
+	for _, test := range tests {
+		if result := NumericComparator.Compare([]byte(test.a), []byte(test.b)); result != test.expected {
+			t.Fatalf("expected %d comparing %s and %s, got %d", test.expected, test.a, test.b, result)
+		}
+	}
+}
+
+func TestComparator_Reverse(t *testing.T) {
+	if ReverseBytewiseComparator.Compare([]byte("a"), []byte("b")) <= 0 {
+		t.Fatal("expected a to sort after b")
+	}
+
+	if ReverseBytewiseComparator.Compare([]byte("a"), []byte("a")) != 0 {
+		t.Fatal("expected a to equal a")
+	}
+}
+
+func TestLSMT_NumericComparator(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1, WithComparator(NumericComparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 30; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("item%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keys 2 through 12 in numeric order, spread over SSTables and the memtable
+	keys, values, err := lsmt.Range([]byte("item2"), []byte("item12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 11 {
+		t.Fatalf("expected 11 keys, got %d", len(keys))
+	}
+
+	for i, key := range keys {
+		if string(key) != fmt.Sprintf("item%d", i+2) || string(values[i]) != fmt.Sprintf("value%d", i+2) {
+			t.Fatalf("expected item%d, got %s", i+2, key)
+		}
+	}
+
+	keys, _, err = lsmt.GreaterThan([]byte("item27"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || string(keys[0]) != "item28" || string(keys[1]) != "item29" {
+		t.Fatalf("expected item28 and item29, got %q", keys)
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and check the order survives
+	lsmt, err = New("test_lsm_tree", 0755, 10, 100, 1, WithComparator(NumericComparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	keys, _, err = lsmt.LessThan([]byte("item3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 3 || string(keys[2]) != "item2" {
+		t.Fatalf("expected item0, item1 and item2, got %q", keys)
+	}
+
+	value, err := lsmt.Get([]byte("item17"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "value17" {
+		t.Fatalf("expected value17, got %s", value)
+	}
+}
+
+func TestLSMT_ComparatorMismatch(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1, WithComparator(ReverseBytewiseComparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New("test_lsm_tree", 0755, 10, 100, 1)
+	if err == nil {
+		t.Fatal("expected an error opening with a different comparator")
+	}
+}
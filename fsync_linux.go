@@ -0,0 +1,45 @@
+//go:build linux
+
+// Package lsmt
+// File syncing for linux
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdatasync flushes the data of the file to disk, skipping metadata such as the modification time which reads don't need
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
+
+// syncDirectory flushes the entries of a directory to disk, so that files created or removed in it survive a crash
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
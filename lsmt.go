@@ -20,48 +20,85 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
-	"github.com/guycipher/lsmt/avl"
+	"hash/maphash"
 	"io"
+	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const SSTABLE_EXTENSION = ".sst"
 const TOMBSTONE_VALUE = "$tombstone"
 const WAL_EXTENSION = ".wal"
+const WAL_PAGE_SIZE = 512    // The write-ahead log appends small operations one page each
+const KEY_LOCK_STRIPES = 256 // Number of locks ordering writers of the same key to a concurrent memtable
 
 // LSMT is the main struct for the log-structured merge-tree.
 type LSMT struct {
-	memtable           *avl.AVLTree   // The memtable is an in-memory AVL tree.
-	memtableSize       atomic.Int64   // The size of the memtable.
-	memtableLock       *sync.RWMutex  // Lock for the memtable.
-	sstables           []*SSTable     // The list of current SSTables.
-	sstablesLock       *sync.RWMutex  // Lock for the list of SSTables.
-	directory          string         // The directory where the SSTables are stored.
-	memtableFlushSize  int            // The size at which the memtable should be flushed to disk.
-	compactionInterval int            // The interval at which the LSM-tree should be compacted. (in number of SSTables)
-	minimumSSTables    int            // The minimum number of SSTables to keep.  On compaction, we will always keep this number of SSTables instead of one large SSTable.
-	activeTransactions []*Transaction // List of active transactions
-	wal                *Wal           // write-ahead log
-	isFlushing         atomic.Int32   // Whether the LSM-tree is flushing
-	isCompacting       atomic.Int32   // Whether the LSM-tree is compacting
-	cond               *sync.Cond     // Condition variable for signaling when the LSM-tree is flushing or compacting
+	memtable            Memtable           // The memtable holds the latest writes in memory.
+	memtableFactory     MemtableFactory    // Creates the memtables.
+	concurrentMemtable  bool               // Whether the memtables can be written by many goroutines at once.
+	memtableSize        atomic.Int64       // The number of entries in the memtable.
+	memtableBytes       atomic.Int64       // The memory taken by the memtable, keys, values and nodes.
+	memoryBudget        *MemoryBudget      // The memory budget shared with other LSM-trees, nil if there is none.
+	memtableLock        *sync.RWMutex      // Lock for the memtable.
+	keyLocks            []sync.Mutex       // Locks ordering writers of the same key to a concurrent memtable, keys share a fixed set of locks.
+	keyLockSeed         maphash.Seed       // The seed hashing keys to their lock.
+	sstables            []*SSTable         // The list of current SSTables.
+	sstablesLock        *sync.RWMutex      // Lock for the list of SSTables.
+	directory           string             // The directory where the SSTables are stored.
+	memtableFlushSize   int                // The size at which the memtable should be flushed to disk.
+	memtableFlushBytes  int64              // The bytes at which the memtable should be flushed to disk, 0 being no limit.
+	compactionStrategy  CompactionStrategy // When the LSM-tree compacts its SSTables.
+	compactionInterval  int                // The interval at which the LSM-tree should be compacted. (in number of SSTables)
+	minimumSSTables     int                // The minimum number of SSTables to keep.  On compaction, we will always keep this number of SSTables instead of one large SSTable.
+	pageSize            int                // The page size of new SSTables.
+	pageCache           *PageCache         // The page cache shared by the SSTables, nil if there is none.
+	mmap                bool               // Whether SSTables are read through memory maps.
+	truncateWal         bool               // Whether the write-ahead log is emptied when the memtable is flushed.
+	activeTransactions  []*Transaction     // List of active transactions
+	rangeTombstones     []*rangeTombstone  // Range tombstones recorded since the last memtable flush.
+	rangeTombstonesSize int64              // The memory taken by the range tombstones.
+	sstableSeq          atomic.Int64       // The number used to name the next SSTable file.
+	defaultTTL          time.Duration      // The time to live given to keys put without one, 0 means keys never expire.
+	comparator          Comparator         // The comparator ordering the keys.
+	mergeOperator       MergeOperator      // The merge operator used to fold merge operands, nil if merges are not used.
+	compactionFilter    CompactionFilter   // The filter invoked for every key-value pair compaction writes, nil if not used.
+	compactionStats     CompactionStats    // Statistics about the compactions run.
+	compactionStatsLock *sync.RWMutex      // Lock for the compaction statistics.
+	logger              *log.Logger        // Receives flush and compaction events.
+	readOnly            bool               // Whether writes are rejected.
+	wal                 *Wal               // write-ahead log
+	isFlushing          atomic.Int32       // Whether the LSM-tree is flushing
+	isCompacting        atomic.Int32       // Whether the LSM-tree is compacting
+	cond                *sync.Cond         // Condition variable for signaling when the LSM-tree is flushing or compacting
 }
 
 // Wal is a struct representing a write-ahead log.
 type Wal struct {
-	pager *Pager        // The pager for the write-ahead log.
-	lock  *sync.RWMutex // Lock for the write-ahead log.
+	pager    *Pager        // The pager for the write-ahead log.
+	lock     *sync.RWMutex // Lock for the write-ahead log.
+	syncMode SyncMode      // When writes are synced to disk.
 }
 
 // SSTable is a struct representing a sorted string table.
 type SSTable struct {
-	pager  *Pager        // The pager for the SSTable.
-	minKey []byte        // The minimum key in the SSTable.
-	maxKey []byte        // The maximum key in the SSTable.
-	lock   *sync.RWMutex // Lock for the SSTable.
+	pager           *Pager            // The pager for the SSTable.
+	minKey          []byte            // The minimum key in the SSTable.
+	maxKey          []byte            // The maximum key in the SSTable.
+	rangeTombstones []*rangeTombstone // The range tombstones stored in the SSTable.
+	lock            *sync.RWMutex     // Lock for the SSTable.
+}
+
+// rangeTombstone marks every key between start and end (inclusive) as deleted.
+type rangeTombstone struct {
+	start []byte // The first key covered by the tombstone.
+	end   []byte // The last key covered by the tombstone.
 }
 
 // OperationType is an enum representing the type of operation.
@@ -70,13 +107,18 @@ type OperationType int
 const (
 	OpPut OperationType = iota
 	OpDelete
+	OpDeleteRange
+	OpMerge
+	OpCheckpoint // Logged once the operations before it are flushed to an SSTable
 )
 
 // Operation is a struct representing an operation in a transaction.
 type Operation struct {
-	Type  OperationType
-	Key   []byte // The key of the operation.
-	Value []byte // Only used for OpPut
+	Type    OperationType
+	Key     []byte // The key of the operation.
+	Value   []byte // Only used for OpPut and OpMerge, the merge operand
+	End     []byte // Only used for OpDeleteRange, the last key of the range
+	Expires int64  // Only used for OpPut, the unix nano time the key expires at or 0
 }
 
 // Transaction is a struct representing a transaction.
@@ -90,54 +132,135 @@ type SSTableIterator struct {
 	pager       *Pager
 	currentPage int64
 	maxPages    int64
+	batch       [][]byte // pages read ahead from the current page
 }
 
 // New creates a new LSM-tree or opens an existing one.
-func New(directory string, directoryPerm os.FileMode, memtableFlushSize, compactionInterval int, minimumSSTables int) (*LSMT, error) {
+// The positional arguments are applied first, so options given in opts override them, see Open.
+// The memtable is only flushed by its entry count unless WithMemtableFlushBytes sets a byte threshold.
+func New(directory string, directoryPerm os.FileMode, memtableFlushSize, compactionInterval int, minimumSSTables int, opts ...Option) (*LSMT, error) {
+	return Open(directory, append([]Option{
+		WithDirectoryPerm(directoryPerm),
+		WithMemtableFlushSize(memtableFlushSize),
+		WithMemtableFlushBytes(0),
+		WithCompactionInterval(compactionInterval),
+		WithMinimumSSTables(minimumSSTables),
+	}, opts...)...)
+}
+
+// Open creates a new LSM-tree or opens an existing one in the directory.
+// Options not provided keep the values of DefaultOptions.
+func Open(directory string, opts ...Option) (*LSMT, error) {
 	if directory == "" {
 		return nil, errors.New("directory cannot be empty")
 	}
 
+	options := DefaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	l := &LSMT{
+		memtableLock:        &sync.RWMutex{},
+		sstables:            make([]*SSTable, 0),
+		sstablesLock:        &sync.RWMutex{},
+		directory:           directory,
+		memtableFlushSize:   options.MemtableFlushSize,
+		memtableFlushBytes:  options.MemtableFlushBytes,
+		compactionStrategy:  options.CompactionStrategy,
+		compactionInterval:  options.CompactionInterval,
+		minimumSSTables:     options.MinimumSSTables,
+		pageSize:            options.PageSize,
+		pageCache:           options.PageCache,
+		mmap:                options.Mmap,
+		truncateWal:         options.TruncateWal,
+		defaultTTL:          options.DefaultTTL,
+		comparator:          options.Comparator,
+		mergeOperator:       options.MergeOperator,
+		compactionFilter:    options.CompactionFilter,
+		logger:              options.logger(),
+		readOnly:            options.ReadOnly,
+		memoryBudget:        options.MemoryBudget,
+		memtableFactory:     options.Memtable,
+		cond:                sync.NewCond(&sync.Mutex{}),
+		compactionStatsLock: &sync.RWMutex{},
+	}
+
+	l.memtable = l.newMemtable()
+	l.concurrentMemtable = l.memtable.Concurrent()
+
+	if l.concurrentMemtable {
+		l.keyLocks = make([]sync.Mutex, KEY_LOCK_STRIPES)
+		l.keyLockSeed = maphash.MakeSeed()
+	}
+
+	if l.pageCache == nil && options.PageCacheSize > 0 {
+		l.pageCache = NewPageCache(options.PageCacheSize)
+	}
+
 	// Check if the directory exists
 	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		if l.readOnly {
+			return nil, errors.New("cannot open a read-only lsm-tree which does not exist")
+		}
+
 		// Create the directory if it doesn't exist
-		err = os.Mkdir(directory, directoryPerm)
+		err = os.Mkdir(directory, options.DirectoryPerm)
+		if err != nil {
+			return nil, err
+		}
+
+		// Record the comparator of the new LSM-tree
+		err = checkComparator(directory, l.comparator, true, false)
 		if err != nil {
 			return nil, err
 		}
 
 		// Create the write-ahead log
-		walPager, err := OpenPager(directory+string(os.PathSeparator)+WAL_EXTENSION, os.O_CREATE|os.O_RDWR, 0644)
+		walPager, err := OpenPager(directory+string(os.PathSeparator)+WAL_EXTENSION, os.O_CREATE|os.O_RDWR, 0644, WAL_PAGE_SIZE)
 		if err != nil {
 			return nil, err
 		}
 
-		return &LSMT{
-			memtable:           avl.NewAVLTree(),
-			memtableLock:       &sync.RWMutex{},
-			sstables:           make([]*SSTable, 0),
-			sstablesLock:       &sync.RWMutex{},
-			directory:          directory,
-			memtableFlushSize:  memtableFlushSize,
-			compactionInterval: compactionInterval,
-			minimumSSTables:    minimumSSTables,
-			wal:                &Wal{lock: &sync.RWMutex{}, pager: walPager},
-			cond:               sync.NewCond(&sync.Mutex{}),
-		}, nil
+		l.wal = &Wal{lock: &sync.RWMutex{}, pager: walPager, syncMode: options.SyncMode}
+
+		if l.memoryBudget != nil {
+			l.memoryBudget.register(l)
+		}
+
+		l.logger.Printf("created lsm-tree %s", directory)
+
+		return l, nil
 	} else {
 
-		// Open the write-ahead log
-		walPager, err := OpenPager(directory+string(os.PathSeparator)+WAL_EXTENSION, os.O_RDWR, 0644)
+		// Make sure the keys are ordered the way they were when the LSM-tree was created
+		err = checkComparator(directory, l.comparator, false, l.readOnly)
 		if err != nil {
 			return nil, err
 		}
 
+		// A read-only LSM-tree does not write to the write-ahead log
+		if !l.readOnly {
+			// Open the write-ahead log
+			walPager, err := OpenPager(directory+string(os.PathSeparator)+WAL_EXTENSION, os.O_RDWR, 0644, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			l.wal = &Wal{lock: &sync.RWMutex{}, pager: walPager, syncMode: options.SyncMode}
+		}
+
 		files, err := os.ReadDir(directory)
 		if err != nil {
 			return nil, err
 		}
 
-		sstables := make([]*SSTable, 0)
+		// SSTables are numbered in the order they were created, the lowest number being the oldest.
+		sstableNumbers := make([]int64, 0)
 
 		for _, file := range files {
 			if file.IsDir() {
@@ -148,39 +271,120 @@ func New(directory string, directoryPerm os.FileMode, memtableFlushSize, compact
 				continue
 			}
 
+			number, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), SSTABLE_EXTENSION), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			sstableNumbers = append(sstableNumbers, number)
+		}
+
+		slices.Sort(sstableNumbers)
+
+		for _, number := range sstableNumbers {
 			// Open the SSTable file
-			sstablePager, err := OpenPager(fmt.Sprintf("%s%s%s", directory, string(os.PathSeparator), file.Name()), os.O_RDWR, 0644)
+			sstable, err := openSSTable(fmt.Sprintf("%s%s%d%s", directory, string(os.PathSeparator), number, SSTABLE_EXTENSION), l.comparator, l.readOnly, l.mmap)
 			if err != nil {
 				return nil, err
 			}
 
-			// Create a new SSTable
-			sstable := &SSTable{
-				minKey: nil,
-				maxKey: nil,
-				lock:   &sync.RWMutex{},
-				pager:  sstablePager,
-			}
+			sstable.pager.SetPageCache(l.pageCache)
 
 			// Add the SSTable to the list of SSTables
-			sstables = append(sstables, sstable)
+			l.sstables = append(l.sstables, sstable)
+		}
+
+		if len(sstableNumbers) > 0 {
+			l.sstableSeq.Store(sstableNumbers[len(sstableNumbers)-1] + 1)
+		}
+
+		// A read-only LSM-tree has no memtable to flush for the budget
+		if l.memoryBudget != nil && !l.readOnly {
+			l.memoryBudget.register(l)
+		}
+
+		l.logger.Printf("opened lsm-tree %s with %d sstables", directory, len(l.sstables))
+
+		return l, nil
+
+	}
+
+}
+
+// newMemtable creates an empty memtable ordered by the comparator of the LSM-tree.
+func (l *LSMT) newMemtable() Memtable {
+	return l.memtableFactory(l.comparator)
+}
+
+// openSSTable opens an existing SSTable file, loading its key range and range tombstones.
+func openSSTable(fileName string, comparator Comparator, readOnly bool, mmap bool) (*SSTable, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	// The SSTable is read with the page size it was written with
+	var sstablePager *Pager
+	var err error
+	if mmap {
+		sstablePager, err = OpenMappedPager(fileName, 0)
+	} else {
+		sstablePager, err = OpenPager(fileName, flag, 0644, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sstable := &SSTable{
+		lock:  &sync.RWMutex{},
+		pager: sstablePager,
+	}
+
+	pageCount := sstablePager.PagesCount()
+	for i := int64(0); i < pageCount; i += RUN_PAGES {
+		batch, err := readPageBatch(sstablePager, i, pageCount)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, data := range batch {
+			// Overflow pages are read with the page they continue
+			if data == nil {
+				continue
+			}
+
+			kv, err := decodeKv(data)
+			if err != nil {
+				return nil, err
+			}
+
+			last := kv.Key
+			if kv.RangeEnd != nil {
+				sstable.rangeTombstones = append(sstable.rangeTombstones, &rangeTombstone{start: kv.Key, end: kv.RangeEnd})
+				last = kv.RangeEnd
+			}
+
+			if sstable.minKey == nil || comparator.Compare(kv.Key, sstable.minKey) < 0 {
+				sstable.minKey = kv.Key
+			}
+
+			if sstable.maxKey == nil || comparator.Compare(last, sstable.maxKey) > 0 {
+				sstable.maxKey = last
+			}
 		}
+	}
 
-		return &LSMT{
-			memtable:           avl.NewAVLTree(),
-			memtableLock:       &sync.RWMutex{},
-			sstables:           sstables,
-			sstablesLock:       &sync.RWMutex{},
-			directory:          directory,
-			memtableFlushSize:  memtableFlushSize,
-			compactionInterval: compactionInterval,
-			minimumSSTables:    minimumSSTables,
-			wal:                &Wal{lock: &sync.RWMutex{}, pager: walPager},
-			cond:               sync.NewCond(&sync.Mutex{}),
-		}, nil
+	return sstable, nil
+}
 
+// readPageBatch reads up to RUN_PAGES pages from a page, stopping before the page to.
+func readPageBatch(pager *Pager, from, to int64) ([][]byte, error) {
+	pageIDs := make([]int64, 0, min(to-from, RUN_PAGES))
+	for pageID := from; pageID < to && len(pageIDs) < RUN_PAGES; pageID++ {
+		pageIDs = append(pageIDs, pageID)
 	}
 
+	return pager.ReadPages(pageIDs)
 }
 
 // encodeOperation encodes an operation.
@@ -207,11 +411,35 @@ func decodeOperation(data []byte) (Operation, error) {
 }
 
 // WriteOperation writes an operation to the write-ahead log.
+// The operation is encoded before the log is locked, the log is only held to append it.
 func (wal *Wal) WriteOperation(op Operation) error {
+	encoded, err := encodeOperation(op)
+	if err != nil {
+		return err
+	}
+
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
 
-	encoded, err := encodeOperation(op)
+	_, err = wal.pager.Write(encoded)
+	if err != nil {
+		return err
+	}
+
+	if wal.syncMode == SyncAlways {
+		return wal.pager.Sync()
+	}
+
+	return nil
+}
+
+// Checkpoint logs that the operations before it are flushed to an SSTable, replaying the log skips them.
+// The checkpoint is synced, a checkpoint lost in a crash would replay merge operands which are already in an SSTable.
+func (wal *Wal) Checkpoint() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	encoded, err := encodeOperation(Operation{Type: OpCheckpoint})
 	if err != nil {
 		return err
 	}
@@ -221,10 +449,18 @@ func (wal *Wal) WriteOperation(op Operation) error {
 		return err
 	}
 
-	return nil
+	return wal.pager.Sync()
+}
+
+// Truncate empties the write-ahead log.
+func (wal *Wal) Truncate() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.pager.Truncate()
 }
 
-// Recover reads the write-ahead log and recovers the operations.
+// Recover reads the write-ahead log and recovers the operations, checkpoints included.
 func (wal *Wal) Recover() ([]Operation, error) {
 	wal.lock.Lock()
 	defer wal.lock.Unlock()
@@ -234,10 +470,24 @@ func (wal *Wal) Recover() ([]Operation, error) {
 	pageCount := wal.pager.Count()
 	for i := int64(0); i < pageCount; i++ {
 		data, err := wal.pager.GetPage(i)
-		if err != nil {
+		if errors.Is(err, ErrCorruptPage) {
+			// A write torn by a crash leaves corrupt pages at the end of the log, the operations before them are recovered
+			torn, tornErr := wal.tornFrom(i+1, pageCount)
+			if tornErr != nil || !torn {
+				return nil, errors.Join(err, tornErr)
+			}
+
+			// The torn pages are freed, so the next operations are not logged after them
+			return operations, wal.pager.FreeFrom(i)
+		} else if err != nil {
 			return nil, err
 		}
 
+		// Overflow pages are read with the page they continue
+		if data == nil {
+			continue
+		}
+
 		op, err := decodeOperation(data)
 		if err != nil {
 			return nil, err
@@ -249,21 +499,68 @@ func (wal *Wal) Recover() ([]Operation, error) {
 	return operations, nil
 }
 
-// RunRecoveredOperations runs the recovered operations from the write-ahead log.
+// tornFrom returns whether no operation is logged in the pages from a page to count, the pages being corrupt or empty.
+func (wal *Wal) tornFrom(pageID, count int64) (bool, error) {
+	for ; pageID < count; pageID++ {
+		data, err := wal.pager.GetPage(pageID)
+		if errors.Is(err, ErrCorruptPage) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		if data != nil {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// RunRecoveredOperations applies the recovered operations from the write-ahead log to the memtable, without logging them again.
+// The operations before the last checkpoint are in SSTables already and are skipped.
 func (l *LSMT) RunRecoveredOperations(operations []Operation) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
+	for i := len(operations) - 1; i >= 0; i-- {
+		if operations[i].Type == OpCheckpoint {
+			operations = operations[i+1:]
+			break
+		}
+	}
+
+	// The memtable is not flushed until every operation is applied, a checkpoint written midway would skip the rest on the next recovery
+	l.memtableLock.Lock()
 	for _, op := range operations {
-		switch op.Type {
-		case OpPut:
-			err := l.Put(op.Key, op.Value)
-			if err != nil {
-				return err
-			}
-		case OpDelete:
-			err := l.Delete(op.Key)
-			if err != nil {
-				return err
-			}
+		err := l.applyOperation(op)
+		if err != nil {
+			l.memtableLock.Unlock()
+			return err
+		}
+	}
+	l.memtableLock.Unlock()
+
+	// If the memtable size exceeds the flush size, flush the memtable to disk.
+	return l.flushIfFull()
+}
+
+// applyOperation applies an operation of the write-ahead log to the memtable, the caller must hold the memtable lock.
+func (l *LSMT) applyOperation(op Operation) error {
+	switch op.Type {
+	case OpPut:
+		return l.memtableInsert(&KeyValue{Key: op.Key, Value: op.Value, Expires: op.Expires})
+	case OpDelete:
+		return l.memtableInsert(&KeyValue{Key: op.Key, Value: []byte(TOMBSTONE_VALUE)})
+	case OpDeleteRange:
+		l.deleteRangeMemtable(op.Key, op.End)
+	case OpMerge:
+		if l.mergeOperator == nil {
+			return errors.New("no merge operator registered")
 		}
+
+		return l.mergeMemtable(op.Key, op.Value)
 	}
 
 	return nil
@@ -275,26 +572,72 @@ func (it *SSTableIterator) Ok() bool {
 }
 
 // Next returns the next key-value pair from the SSTable.
+// Range tombstones are loaded with the SSTable and are not returned by the iterator.
 func (it *SSTableIterator) Next() (*KeyValue, error) {
-	// Read the next key-value pair from the SSTable.
-	data, err := it.pager.GetPage(it.currentPage)
-	if err != nil {
-		return nil, err
-	}
+	for it.Ok() {
+		// The pages are read in batches, a scan reads the SSTable sequentially
+		if len(it.batch) == 0 {
+			batch, err := readPageBatch(it.pager, it.currentPage, it.maxPages)
+			if err != nil {
+				return nil, err
+			}
 
-	kv, err := decodeKv(data)
-	if err != nil {
-		return nil, err
-	}
+			it.batch = batch
+		}
 
-	it.currentPage++
+		// Read the next key-value pair from the SSTable.
+		data := it.batch[0]
+		it.batch = it.batch[1:]
 
-	return kv, nil
+		it.currentPage++
 
+		// Overflow pages are read with the page they continue
+		if data == nil {
+			continue
+		}
+
+		kv, err := decodeKv(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if kv.RangeEnd != nil {
+			continue
+		}
+
+		return kv, nil
+	}
+
+	return nil, io.EOF
 }
 
 // Put inserts a key-value pair into the LSM-tree.
+// The key expires after the default time to live of the LSM-tree if one is set.
 func (l *LSMT) Put(key, value []byte) error {
+	var expires int64
+	if l.defaultTTL > 0 {
+		expires = time.Now().Add(l.defaultTTL).UnixNano()
+	}
+
+	return l.put(key, value, expires)
+}
+
+// PutWithTTL inserts a key-value pair into the LSM-tree which expires after ttl.
+// Expired keys are hidden from reads and removed on compaction.
+func (l *LSMT) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be greater than zero")
+	}
+
+	return l.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// put inserts a key-value pair expiring at the provided unix nano time, 0 meaning never, into the LSM-tree.
+func (l *LSMT) put(key, value []byte, expires int64) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
 	// We will first put the key-value pair in the memtable.
 	// If the memtable size exceeds the flush size, we will flush the memtable to disk.
 
@@ -305,39 +648,95 @@ func (l *LSMT) Put(key, value []byte) error {
 	}
 	l.cond.L.Unlock()
 
-	// Lock memtable for writing.
-	l.memtableLock.Lock()
-	defer l.memtableLock.Unlock()
+	// Check if value is tombstone
+	if bytes.Compare(value, []byte(TOMBSTONE_VALUE)) == 0 {
+		return errors.New("value cannot be a tombstone")
+	}
 
-	// Append the operation to the write-ahead log.
+	unlock := l.lockKey(key)
+
+	// Append the operation to the write-ahead log, then put the key-value pair in the memtable.
 	err := l.wal.WriteOperation(Operation{
-		Type:  OpPut,
-		Key:   key,
-		Value: value,
+		Type:    OpPut,
+		Key:     key,
+		Value:   value,
+		Expires: expires,
 	})
+	if err == nil {
+		err = l.memtableInsert(&KeyValue{Key: key, Value: value, Expires: expires})
+	}
+	unlock()
 	if err != nil {
 		return err
 	}
 
-	// Check if value is tombstone
-	if bytes.Compare(value, []byte(TOMBSTONE_VALUE)) == 0 {
-		return errors.New("value cannot be a tombstone")
+	// If the memtable size exceeds the flush size, flush the memtable to disk.
+	return l.flushIfFull()
+}
+
+// lockKey locks the memtable for writing the key, returning the function unlocking it.
+// A concurrent memtable is written under the read lock so writers do not wait on each other, flushes still take the write lock.
+// Writers of the same key also share a key lock, so they log their operations and apply them to the memtable in the same order and replaying the log gives what readers saw.
+func (l *LSMT) lockKey(key []byte) func() {
+	if !l.concurrentMemtable {
+		l.memtableLock.Lock()
+		return l.memtableLock.Unlock
 	}
 
-	// Put the key-value pair in the memtable.
-	l.memtable.Insert(key, value)
+	l.memtableLock.RLock()
 
-	// If the memtable size exceeds the flush size, flush the memtable to disk.
-	if l.memtableSize.Load() > int64(l.memtableFlushSize) {
-		if err := l.flushMemtable(); err != nil {
-			return err
-		}
-	} else {
-		l.memtableSize.Store(l.memtableSize.Load() + 1)
+	keyLock := &l.keyLocks[maphash.Bytes(l.keyLockSeed, key)%KEY_LOCK_STRIPES]
+	keyLock.Lock()
 
+	return func() {
+		keyLock.Unlock()
+		l.memtableLock.RUnlock()
 	}
+}
 
-	return nil
+// readMemtable returns a view of the memtable to read and the range tombstones recorded since the last memtable flush.
+// A memtable which can be snapshotted is read without the memtable lock, so readers do not block writers.
+// Otherwise the memtable read lock is held until release is called.
+func (l *LSMT) readMemtable() (memtable MemtableReader, rangeTombstones []*rangeTombstone, release func()) {
+	l.memtableLock.RLock()
+
+	rangeTombstones = append(rangeTombstones, l.rangeTombstones...)
+
+	if snapshotMemtable, ok := l.memtable.(SnapshotMemtable); ok {
+		memtable = snapshotMemtable.Snapshot()
+		l.memtableLock.RUnlock()
+		return memtable, rangeTombstones, func() {}
+	}
+
+	return l.memtable, rangeTombstones, l.memtableLock.RUnlock
+}
+
+// flushIfFull flushes the memtable to disk if it reached its flush size, then the largest memtable sharing the memory budget if it is exceeded.
+// The memtable lock must not be held.
+func (l *LSMT) flushIfFull() error {
+	err := l.flushOwnIfFull()
+	if err != nil {
+		return err
+	}
+
+	return l.flushBudget()
+}
+
+// flushOwnIfFull flushes the memtable to disk if it reached its flush size.
+func (l *LSMT) flushOwnIfFull() error {
+	if !l.memtableFull() {
+		return nil
+	}
+
+	l.memtableLock.Lock()
+	defer l.memtableLock.Unlock()
+
+	// Another writer may have flushed the memtable while we waited for the lock
+	if !l.memtableFull() {
+		return nil
+	}
+
+	return l.flushMemtable()
 }
 
 // getSSTableIterator returns an iterator for the SSTable.
@@ -356,7 +755,7 @@ func (l *LSMT) flushMemtable() error {
 	l.isFlushing.Store(1)
 
 	// Create a new SSTable from the memtable.
-	sstable, err := l.newSSTable(l.directory, l.memtable)
+	sstable, err := l.newSSTable(l.directory, l.memtable, l.rangeTombstones)
 	if err != nil {
 		l.isFlushing.Store(0)
 		return err
@@ -367,14 +766,34 @@ func (l *LSMT) flushMemtable() error {
 	defer l.sstablesLock.Unlock()
 
 	// Add the SSTable to the list of SSTables.
-	l.sstables = append(l.sstables, sstable)
+	if sstable != nil {
+		l.sstables = append(l.sstables, sstable)
+	}
 
 	// Clear the memtable.
-	l.memtable = avl.NewAVLTree()
+	l.memtable = l.newMemtable()
+	l.rangeTombstones = nil
+	l.rangeTombstonesSize = 0
 	l.memtableSize.Swap(0)
+	l.updateMemory()
+
+	if sstable != nil {
+		l.logger.Printf("flushed memtable to %s", sstable.pager.file.Name())
+	}
+
+	// The operations of the write-ahead log are in the synced SSTable now
+	if l.truncateWal {
+		err = l.wal.Truncate()
+	} else {
+		err = l.wal.Checkpoint()
+	}
+	if err != nil {
+		l.isFlushing.Store(0)
+		return err
+	}
 
 	// Check the amount of sstables and if we need to compact
-	if len(l.sstables) > l.compactionInterval {
+	if l.compactionStrategy == CompactionFull && len(l.sstables) > l.compactionInterval {
 		if err := l.Compact(); err != nil {
 			l.isFlushing.Store(0)
 			return err
@@ -392,51 +811,188 @@ func (l *LSMT) flushMemtable() error {
 
 // KeyValue is a struct representing a key-value pair.
 type KeyValue struct {
-	Key   []byte
-	Value []byte
+	Key      []byte
+	Value    []byte
+	RangeEnd []byte   // Only set for range tombstones, the last key of the deleted range
+	Expires  int64    // The unix nano time the key expires at, 0 if it never expires
+	Operands [][]byte // Only set for merge records, the merge operands from the oldest to the newest
 }
 
-// newSSTable creates a new SSTable file from the memtable.
-func (l *LSMT) newSSTable(directory string, memtable *avl.AVLTree) (*SSTable, error) {
+// MergeOperator folds merge operands into the value of a key, in the style of RocksDB merge operators.
+type MergeOperator interface {
+	// FullMerge applies the operands, from the oldest to the newest, to the existing value of the key.
+	// existing is nil if the key has no value.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
 
-	// Create a sorted map from the memtable which will be used to create the SSTable.
+// CompactionDecision is the decision of a compaction filter for a key-value pair.
+type CompactionDecision int
 
-	sstableSlice := make([]*KeyValue, 0)
+const (
+	CompactionKeep        CompactionDecision = iota // Keep the key-value pair as is
+	CompactionRemove                                // Remove the key-value pair
+	CompactionChangeValue                           // Replace the value of the key-value pair
+)
 
-	memtable.InOrderTraversal(func(node *avl.Node) {
-		sstableSlice = append(sstableSlice, &KeyValue{Key: node.Key, Value: node.Value})
-	})
+// CompactionFilter is invoked for every live key-value pair compaction writes.
+type CompactionFilter interface {
+	// Filter decides what happens to the key-value pair, the returned value is only used with CompactionChangeValue.
+	Filter(key, value []byte) (CompactionDecision, []byte)
+}
 
-	if len(sstableSlice) == 0 {
-		return nil, nil
-	}
+// CompactionStats holds statistics about the compactions of an LSM-tree.
+type CompactionStats struct {
+	Compactions       int64 // The number of compactions run.
+	EntriesRead       int64 // The number of key-value pairs read from the compacted SSTables.
+	EntriesWritten    int64 // The number of key-value pairs written to the new SSTables.
+	TombstonesDropped int64 // The number of tombstones and range tombstones dropped.
+	ExpiredDropped    int64 // The number of expired key-value pairs dropped.
+	MergesFolded      int64 // The number of merge records folded into a value.
+	FilterKept        int64 // The number of key-value pairs the compaction filter kept.
+	FilterRemoved     int64 // The number of key-value pairs the compaction filter removed.
+	FilterChanged     int64 // The number of key-value pairs the compaction filter changed the value of.
+}
 
-	// Based on amount of sstables we name the file
-	fileName := fmt.Sprintf("%s%s%d%s", directory, string(os.PathSeparator), len(l.sstables), SSTABLE_EXTENSION)
+// add adds the statistics of a compaction.
+func (s *CompactionStats) add(stats CompactionStats) {
+	s.Compactions += stats.Compactions
+	s.EntriesRead += stats.EntriesRead
+	s.EntriesWritten += stats.EntriesWritten
+	s.TombstonesDropped += stats.TombstonesDropped
+	s.ExpiredDropped += stats.ExpiredDropped
+	s.MergesFolded += stats.MergesFolded
+	s.FilterKept += stats.FilterKept
+	s.FilterRemoved += stats.FilterRemoved
+	s.FilterChanged += stats.FilterChanged
+}
 
-	// Create a new SSTable file.
-	ssltablePager, err := OpenPager(fileName, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, err
-	}
+// isMerge returns whether the key-value pair is a merge record which still has to be folded into an older value.
+func (kv *KeyValue) isMerge() bool {
+	return len(kv.Operands) > 0
+}
 
-	for _, kv := range sstableSlice {
-		encoded, err := encodeKv(kv)
-		if err != nil {
-			return nil, err
-		}
+// isTombstone returns whether the key-value pair marks its key as deleted.
+func (kv *KeyValue) isTombstone() bool {
+	return bytes.Compare(kv.Value, []byte(TOMBSTONE_VALUE)) == 0
+}
+
+// isExpired returns whether the key-value pair has outlived its time to live.
+func (kv *KeyValue) isExpired(now time.Time) bool {
+	return kv.Expires != 0 && now.UnixNano() >= kv.Expires
+}
+
+// insertKv inserts the encoded key-value pair into the memtable.
+// The memtable holds encoded key-value pairs so the expiry of a key is kept with its value.
+func insertKv(memtable Memtable, kv *KeyValue) error {
+	encoded, err := encodeKv(kv)
+	if err != nil {
+		return err
+	}
+
+	memtable.Insert(kv.Key, encoded)
+
+	return nil
+}
+
+// searchKv returns the key-value pair for the key from the memtable, or nil if the key is not in the memtable.
+func searchKv(memtable MemtableReader, key []byte) (*KeyValue, error) {
+	value, ok := memtable.Get(key)
+	if !ok {
+		return nil, nil
+	}
+
+	return decodeKv(value)
+}
+
+// newSSTable creates a new SSTable file from the memtable and its range tombstones.
+func (l *LSMT) newSSTable(directory string, memtable Memtable, rangeTombstones []*rangeTombstone) (*SSTable, error) {
+
+	// Create a sorted list of the encoded key-value pairs in the memtable which will be used to create the SSTable.
+
+	sstableSlice := make([][]byte, 0)
+
+	var minKey, maxKey []byte
+
+	ascend(memtable, nil, func(key, value []byte) bool {
+		if minKey == nil {
+			minKey = key
+		}
+		maxKey = key
+
+		sstableSlice = append(sstableSlice, value)
+
+		return true
+	})
+
+	if len(sstableSlice) == 0 && len(rangeTombstones) == 0 {
+		return nil, nil
+	}
+
+	// Range tombstones are stored after the key-value pairs of the SSTable.
+	for _, rt := range rangeTombstones {
+		encoded, err := encodeKv(&KeyValue{Key: rt.start, Value: []byte(TOMBSTONE_VALUE), RangeEnd: rt.end})
+		if err != nil {
+			return nil, err
+		}
 
-		_, err = ssltablePager.Write(encoded)
+		sstableSlice = append(sstableSlice, encoded)
+
+		if minKey == nil || l.comparator.Compare(rt.start, minKey) < 0 {
+			minKey = rt.start
+		}
+
+		if maxKey == nil || l.comparator.Compare(rt.end, maxKey) > 0 {
+			maxKey = rt.end
+		}
+	}
+
+	// SSTable files are numbered in the order they are created
+	fileName := fmt.Sprintf("%s%s%d%s", directory, string(os.PathSeparator), l.sstableSeq.Add(1)-1, SSTABLE_EXTENSION)
+
+	// Create a new SSTable file.
+	ssltablePager, err := OpenPager(fileName, os.O_CREATE|os.O_RDWR, 0644, l.pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSTable is written as one run of pages, in large sequential writes
+	_, err = ssltablePager.WriteRun(sstableSlice)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSTable and its directory entry are durable before the SSTable is published
+	err = ssltablePager.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	err = syncDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSTable is not written to anymore, it is read through a memory map
+	if l.mmap {
+		err = ssltablePager.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		ssltablePager, err = OpenMappedPager(fileName, 0)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	ssltablePager.SetPageCache(l.pageCache)
+
 	return &SSTable{
-		minKey: sstableSlice[0].Key,
-		maxKey: sstableSlice[len(sstableSlice)-1].Key,
-		lock:   &sync.RWMutex{},
-		pager:  ssltablePager,
+		minKey:          minKey,
+		maxKey:          maxKey,
+		rangeTombstones: rangeTombstones,
+		lock:            &sync.RWMutex{},
+		pager:           ssltablePager,
 	}, nil
 }
 
@@ -463,10 +1019,28 @@ func decodeKv(data []byte) (*KeyValue, error) {
 
 }
 
+// covers returns whether the key is within the range tombstone.
+func (rt *rangeTombstone) covers(comparator Comparator, key []byte) bool {
+	return comparator.Compare(key, rt.start) >= 0 && comparator.Compare(key, rt.end) <= 0
+}
+
+// coveredByRangeTombstone returns whether any of the range tombstones covers the key.
+func coveredByRangeTombstone(comparator Comparator, rangeTombstones []*rangeTombstone, key []byte) bool {
+	for _, rt := range rangeTombstones {
+		if rt.covers(comparator, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Get retrieves the value for a given key from the LSM-tree.
 func (l *LSMT) Get(key []byte) ([]byte, error) {
 	// We will first check the memtable for the key.
 	// If the key is not found in the memtable, we will search the SSTables.
+	// A range tombstone only hides keys that are older than itself, so we stop at the first one covering the key.
+	// Merge records are collected until we find the value they apply to.
 
 	// Check if we are flushing or compacting
 	l.cond.L.Lock()
@@ -475,21 +1049,56 @@ func (l *LSMT) Get(key []byte) ([]byte, error) {
 	}
 	l.cond.L.Unlock()
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
+	now := time.Now()
 
-	// Check the memtable for the key.
-	if node := l.memtable.Search(key); node != nil {
-		l.memtableLock.RUnlock()
+	var operands [][]byte // merge operands found so far, from the oldest to the newest
+
+	// resolve returns the value of the key given its newest entry which is not a merge record, or nil if there is none.
+	resolve := func(kv *KeyValue) ([]byte, error) {
+		if kv != nil && (kv.isTombstone() || kv.isExpired(now)) {
+			kv = nil
+		}
+
+		if len(operands) == 0 {
+			if kv == nil {
+				return nil, errors.New("key not found")
+			}
+
+			return kv.Value, nil
+		}
 
-		if bytes.Compare(node.Value, []byte(TOMBSTONE_VALUE)) == 0 {
-			return nil, errors.New("key not found")
+		var existing []byte
+		if kv != nil {
+			existing = kv.Value
 		}
 
-		return node.Value, nil
+		return l.fullMerge(key, existing, operands)
+	}
+
+	memtable, rangeTombstones, release := l.readMemtable()
+
+	// Check the memtable for the key.
+	kv, err := searchKv(memtable, key)
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	if kv != nil && !kv.isMerge() {
+		return resolve(kv)
+	}
+
+	if kv != nil {
+		operands = kv.Operands
+	}
+
+	if coveredByRangeTombstone(l.comparator, rangeTombstones, key) {
+		return resolve(nil)
 	}
 
-	l.memtableLock.RUnlock()
+	// Lock sstables for reading.
+	l.sstablesLock.RLock()
+	defer l.sstablesLock.RUnlock()
 
 	// Search the SSTables for the key.
 	for i := len(l.sstables) - 1; i >= 0; i-- {
@@ -499,7 +1108,7 @@ func (l *LSMT) Get(key []byte) ([]byte, error) {
 		sstable.lock.RLock()
 
 		// If the key is not within the range of this SSTable, skip it.
-		if bytes.Compare(key, sstable.minKey) < 0 || bytes.Compare(key, sstable.maxKey) > 0 {
+		if l.comparator.Compare(key, sstable.minKey) < 0 || l.comparator.Compare(key, sstable.maxKey) > 0 {
 			sstable.lock.RUnlock()
 			continue
 		}
@@ -520,20 +1129,145 @@ func (l *LSMT) Get(key []byte) ([]byte, error) {
 				sstable.lock.RUnlock()
 				return nil, err
 			}
-			if bytes.Compare(kv.Key, key) == 0 {
-				sstable.lock.RUnlock()
-				return kv.Value, nil
+			if l.comparator.Compare(kv.Key, key) == 0 {
+				if !kv.isMerge() {
+					sstable.lock.RUnlock()
+					return resolve(kv)
+				}
+
+				// The operands of older SSTables apply before the ones we have found so far
+				operands = slices.Concat(kv.Operands, operands)
+				break
 			}
 		}
 
+		covered := coveredByRangeTombstone(l.comparator, sstable.rangeTombstones, key)
+
 		sstable.lock.RUnlock()
+
+		if covered {
+			return resolve(nil)
+		}
+	}
+
+	return resolve(nil)
+}
+
+// fullMerge folds the merge operands into the existing value of the key using the merge operator.
+func (l *LSMT) fullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if l.mergeOperator == nil {
+		return nil, errors.New("no merge operator registered")
+	}
+
+	return l.mergeOperator.FullMerge(key, existing, operands)
+}
+
+// Merge records a merge operand for the key which the merge operator folds into its value.
+// The key does not have to be read first, operands are folded lazily on reads and compaction.
+func (l *LSMT) Merge(key, operand []byte) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
+	if l.mergeOperator == nil {
+		return errors.New("no merge operator registered")
+	}
+
+	// Check if we are flushing or compacting
+	l.cond.L.Lock()
+	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
+		l.cond.Wait()
+	}
+	l.cond.L.Unlock()
+
+	err := l.merge(key, operand)
+	if err != nil {
+		return err
+	}
+
+	// The merge may take the memory budget, the largest memtable sharing it is flushed
+	return l.flushBudget()
+}
+
+// merge records the merge operand in the write-ahead log and the memtable, flushing the memtable if it is full.
+func (l *LSMT) merge(key, operand []byte) error {
+	// Lock memtable for writing.
+	l.memtableLock.Lock()
+	defer l.memtableLock.Unlock()
+
+	// Append the operation to the write-ahead log.
+	err := l.wal.WriteOperation(Operation{
+		Type:  OpMerge,
+		Key:   key,
+		Value: operand,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = l.mergeMemtable(key, operand)
+	if err != nil {
+		return err
+	}
+
+	// If the memtable size exceeds the flush size, flush the memtable to disk.
+	if l.memtableFull() {
+		if err := l.flushMemtable(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeMemtable stacks the merge operand on the key in the memtable, folding it right away if the memtable knows the value of the key.
+// The caller must hold the memtable lock.
+func (l *LSMT) mergeMemtable(key, operand []byte) error {
+	kv, err := searchKv(l.memtable, key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case kv != nil && kv.isMerge():
+		// Stack the operand on the merge record
+		kv.Operands = append(kv.Operands, operand)
+	case kv != nil && (kv.isTombstone() || kv.isExpired(time.Now())):
+		// The key has no value, the operand can be folded right away
+		value, err := l.fullMerge(key, nil, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+
+		kv = &KeyValue{Key: key, Value: value}
+	case kv != nil:
+		value, err := l.fullMerge(key, kv.Value, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+
+		kv.Value = value
+	case coveredByRangeTombstone(l.comparator, l.rangeTombstones, key):
+		value, err := l.fullMerge(key, nil, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+
+		kv = &KeyValue{Key: key, Value: value}
+	default:
+		// The value of the key may be in the SSTables, we keep the operand until reads or compaction find it
+		kv = &KeyValue{Key: key, Operands: [][]byte{operand}}
 	}
 
-	return nil, errors.New("key not found")
+	return l.memtableInsert(kv)
 }
 
 // Delete removes a key from the LSM-tree.
 func (l *LSMT) Delete(key []byte) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
 	// Check if we are flushing or compacting
 	l.cond.L.Lock()
 	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
@@ -541,38 +1275,147 @@ func (l *LSMT) Delete(key []byte) error {
 	}
 	l.cond.L.Unlock()
 
-	// Append the operation to the write-ahead log.
+	unlock := l.lockKey(key)
+
+	// Append the operation to the write-ahead log, then write a tombstone value to the memtable for the key.
 	err := l.wal.WriteOperation(Operation{
-		Type: OpPut,
+		Type: OpDelete,
 		Key:  key,
 	})
+	if err == nil {
+		err = l.memtableInsert(&KeyValue{Key: key, Value: []byte(TOMBSTONE_VALUE)})
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	// If the memtable size exceeds the flush size, flush the memtable to disk.
+	return l.flushIfFull()
+}
+
+// DeleteRange removes all keys between start and end (inclusive) from the LSM-tree.
+// A single range tombstone is written instead of a tombstone for every key.
+func (l *LSMT) DeleteRange(start, end []byte) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
+	if l.comparator.Compare(start, end) > 0 {
+		return errors.New("start key cannot be greater than end key")
+	}
+
+	// Check if we are flushing or compacting
+	l.cond.L.Lock()
+	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
+		l.cond.Wait()
+	}
+	l.cond.L.Unlock()
 
+	err := l.deleteRange(start, end)
 	if err != nil {
 		return err
 	}
 
-	// We will write a tombstone value to the memtable for the key.
+	// The range tombstone may take the memory budget, the largest memtable sharing it is flushed
+	return l.flushBudget()
+}
 
+// deleteRange records the range tombstone in the write-ahead log and the memtable, flushing the memtable if it is full.
+func (l *LSMT) deleteRange(start, end []byte) error {
 	// Lock memtable for writing.
 	l.memtableLock.Lock()
 	defer l.memtableLock.Unlock()
 
-	// Write a tombstone value to the memtable for the key.
-	l.memtable.Insert(key, []byte(TOMBSTONE_VALUE))
+	// Append the operation to the write-ahead log.
+	err := l.wal.WriteOperation(Operation{
+		Type: OpDeleteRange,
+		Key:  start,
+		End:  end,
+	})
+	if err != nil {
+		return err
+	}
+
+	l.deleteRangeMemtable(start, end)
+
+	// If the memtable size exceeds the flush size, flush the memtable to disk.
+	if l.memtableFull() {
+		if err := l.flushMemtable(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// deleteRangeMemtable records the range tombstone with the memtable, the caller must hold the memtable lock.
+func (l *LSMT) deleteRangeMemtable(start, end []byte) {
+	rt := &rangeTombstone{start: start, end: end}
+
+	// Keys already in the memtable are older than the range tombstone, we remove them so entries in the memtable always shadow its range tombstones.
+	removed := deleteRangeFromMemtable(l.comparator, l.memtable, rt)
+	l.memtableSize.Add(-removed)
+
+	l.rangeTombstones = append(l.rangeTombstones, rt)
+	l.rangeTombstonesSize += rangeTombstoneOverhead + int64(len(start)+len(end))
+	l.memtableSize.Add(1)
+	l.updateMemory()
+}
+
+// deleteRangeFromMemtable removes all keys covered by the range tombstone from the memtable, returning the number of keys removed.
+func deleteRangeFromMemtable(comparator Comparator, memtable Memtable, rt *rangeTombstone) int64 {
+	var covered [][]byte
+
+	ascend(memtable, rt.start, func(key, value []byte) bool {
+		if comparator.Compare(key, rt.end) > 0 {
+			return false
+		}
+
+		covered = append(covered, key)
+
+		return true
+	})
+
+	for _, key := range covered {
+		memtable.Delete(key)
+	}
+
+	return int64(len(covered))
+}
+
 // Compact compacts the LSM-tree by merging all SSTables into a single SSTable.
+// Tombstones, expired keys and keys covered by range tombstones are dropped and merge records are folded.
 func (l *LSMT) Compact() error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
 
 	l.isCompacting.Store(1)
 
+	defer func() {
+		l.isCompacting.Store(0)
+
+		// Signal the condition variable
+		l.cond.Broadcast()
+	}()
+
 	// Create a new empty memtable.
-	newMemtable := avl.NewAVLTree()
+	newMemtable := l.newMemtable()
+
+	now := time.Now()
 
-	// Iterate over all existing SSTables.
+	stats := CompactionStats{Compactions: 1}
+
+	// Iterate over all existing SSTables, from the oldest to the newest.
 	for _, sstable := range l.sstables {
+		// The range tombstones of an SSTable delete the keys of older SSTables, which are already in the new memtable.
+		for _, rt := range sstable.rangeTombstones {
+			deleteRangeFromMemtable(l.comparator, newMemtable, rt)
+		}
+
+		stats.TombstonesDropped += int64(len(sstable.rangeTombstones))
+
 		// Read all key-value pairs from the SSTable.
 
 		// Get an iterator for the SSTable file.
@@ -590,118 +1433,217 @@ func (l *LSMT) Compact() error {
 				return err
 			}
 
-			if bytes.Compare(kv.Value, []byte(TOMBSTONE_VALUE)) == 0 { // If the value is a tombstone, skip this key-value pair
+			stats.EntriesRead++
+
+			if kv.isTombstone() || kv.isExpired(now) { // If the value is a tombstone or expired, remove the older value of the key
+				if kv.isTombstone() {
+					stats.TombstonesDropped++
+				} else {
+					stats.ExpiredDropped++
+				}
+
+				newMemtable.Delete(kv.Key)
 				continue
 			}
 
-			// If the value is not a tombstone, add it to the new memtable.
-			newMemtable.Insert(kv.Key, kv.Value)
-		}
-
-		sstable.pager.Close() // Close the SSTable pager.
+			// Merge records are folded into the older value of the key, all older values are in the new memtable.
+			if kv.isMerge() {
+				existing, err := searchKv(newMemtable, kv.Key)
+				if err != nil {
+					return err
+				}
 
-	}
+				var existingValue []byte
+				if existing != nil {
+					existingValue = existing.Value
+					kv.Expires = existing.Expires
+				}
 
-	// We remove all the sstables in the directory lmst directory..
-	files, err := os.ReadDir(l.directory)
-	if err != nil {
-		return err
-	}
+				kv.Value, err = l.fullMerge(kv.Key, existingValue, kv.Operands)
+				if err != nil {
+					return err
+				}
 
-	for _, file := range files {
+				kv.Operands = nil
 
-		if file.IsDir() {
-			continue
-		}
+				stats.MergesFolded++
+			}
 
-		if !strings.HasSuffix(file.Name(), SSTABLE_EXTENSION) {
-			continue
+			// If the value is live, add it to the new memtable.
+			err = insertKv(newMemtable, kv)
+			if err != nil {
+				return err
+			}
 		}
 
-		err = os.Remove(fmt.Sprintf("%s%s%s", l.directory, string(os.PathSeparator), file.Name()))
-		if err != nil {
-			return err
-		}
+	}
 
-		err = os.Remove(fmt.Sprintf("%s%s%s", l.directory, string(os.PathSeparator), file.Name()+".del"))
+	// Let the compaction filter decide on every live key-value pair.
+	if l.compactionFilter != nil {
+		err := l.filterMemtable(newMemtable, &stats)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Clear the sstables
-	l.sstables = make([]*SSTable, 0)
-
-	// Flush the new memtable to disk, creating a new SSTable.
-	newSSTable, err := l.newSSTable(l.directory, newMemtable)
-	if err != nil {
-		return err
-	}
+	stats.EntriesWritten = int64(newMemtable.Len())
 
-	// Replace the list of old SSTables with the new SSTable.
-	l.sstables = []*SSTable{newSSTable}
+	l.compactionStatsLock.Lock()
+	l.compactionStats.add(stats)
+	l.compactionStatsLock.Unlock()
 
-	// We will now split the sstable into smaller sstables
-	l.sstables, err = l.SplitSSTable(newSSTable, l.minimumSSTables)
+	// Flush the new memtable to disk, split into SSTables of equal size.
+	// The old SSTables stay until the new ones are synced, a crash or an error in between loses nothing.
+	sstables, err := l.splitMemtable(newMemtable, nil, l.minimumSSTables)
 	if err != nil {
 		return err
 	}
 
-	l.isFlushing.Store(0)
+	compacted := l.sstables
+	l.sstables = sstables
 
-	// Signal the condition variable
-	l.cond.Broadcast()
+	l.logger.Printf("compacted %d entries into %d sstables", stats.EntriesWritten, len(l.sstables))
 
-	return nil
+	return l.removeSSTables(compacted)
 }
 
-// Close closes the LSM-tree gracefully closing all opened SSTable files.
-func (l *LSMT) Close() error {
-	// Check size of memtable
-	if l.memtableSize.Load() > 0 {
+// removeSSTables closes SSTables once their readers are done and removes their files, returning every error met on the way.
+func (l *LSMT) removeSSTables(sstables []*SSTable) error {
+	var errs []error
 
-		// Flush the memtable to disk.
-		if err := l.flushMemtable(); err != nil {
-			return err
-		}
+	for _, sstable := range sstables {
+		// Wait for the readers of the SSTable before closing its pager, which unmaps a memory-mapped SSTable.
+		sstable.lock.Lock()
+		errs = append(errs, sstable.pager.Close())
+		sstable.lock.Unlock()
+
+		errs = append(errs, os.Remove(sstable.pager.file.Name()))
 	}
 
-	// Close the write-ahead log.
-	if err := l.wal.pager.Close(); err != nil {
+	// The removals are durable once the directory is synced
+	if len(sstables) > 0 {
+		errs = append(errs, syncDirectory(l.directory))
+	}
+
+	return errors.Join(errs...)
+}
+
+// filterMemtable runs the compaction filter over the key-value pairs of the memtable, removing or changing them as decided.
+func (l *LSMT) filterMemtable(memtable Memtable, stats *CompactionStats) error {
+	var removed [][]byte
+	var changed []*KeyValue
+	var err error
+
+	ascend(memtable, nil, func(key, value []byte) bool {
+		var kv *KeyValue
+		kv, err = decodeKv(value)
+		if err != nil {
+			return false
+		}
+
+		decision, newValue := l.compactionFilter.Filter(kv.Key, kv.Value)
+		switch decision {
+		case CompactionRemove:
+			removed = append(removed, kv.Key)
+			stats.FilterRemoved++
+		case CompactionChangeValue:
+			kv.Value = newValue
+			changed = append(changed, kv)
+			stats.FilterChanged++
+		default:
+			stats.FilterKept++
+		}
+
+		return true
+	})
+
+	if err != nil {
 		return err
 	}
 
-	if len(l.sstables) > 0 {
-		// Close all SSTable pagers.
-		for _, sstable := range l.sstables {
-			if sstable.pager != nil {
-				if err := sstable.pager.Close(); err != nil {
-					return err
-				}
-			}
+	for _, key := range removed {
+		memtable.Delete(key)
+	}
 
+	for _, kv := range changed {
+		err = insertKv(memtable, kv)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// SplitSSTable splits a compacted SSTable into n smaller SSTables.
-func (l *LSMT) SplitSSTable(sstable *SSTable, n int) ([]*SSTable, error) {
+// PageCacheStats returns the statistics of the page cache of the SSTables, which are those of every LSM-tree sharing it.
+func (l *LSMT) PageCacheStats() PageCacheStats {
+	if l.pageCache == nil {
+		return PageCacheStats{}
+	}
+
+	return l.pageCache.Stats()
+}
+
+// CompactionStats returns the statistics of all compactions run since the LSM-tree was opened.
+func (l *LSMT) CompactionStats() CompactionStats {
+	l.compactionStatsLock.RLock()
+	defer l.compactionStatsLock.RUnlock()
+
+	return l.compactionStats
+}
+
+// Close closes the LSM-tree gracefully closing all opened SSTable files.
+// Every file is closed even if flushing the memtable or closing another file fails, the errors are returned together.
+func (l *LSMT) Close() error {
+	var errs []error
+
+	// A read-only LSM-tree has no memtable to flush nor write-ahead log
+	if !l.readOnly {
+		// Other LSM-trees sharing the memory budget no longer flush the memtable
+		if l.memoryBudget != nil {
+			l.memoryBudget.unregister(l)
+		}
 
-	memTables := make([]*avl.AVLTree, n)
+		// A flush for the memory budget may be running, it is done once we hold the lock
+		l.memtableLock.Lock()
 
-	for i := 0; i < n; i++ {
-		memTables[i] = avl.NewAVLTree()
+		// Check size of memtable
+		if l.memtableSize.Load() > 0 {
+
+			// Flush the memtable to disk, the pagers are closed even if it fails.
+			errs = append(errs, l.flushMemtable())
+		}
+
+		l.memtableLock.Unlock()
+
+		// Close the write-ahead log.
+		errs = append(errs, l.wal.pager.Close())
+	}
+
+	// Close all SSTable pagers once their readers are done, closing a pager unmaps a memory-mapped SSTable.
+	l.sstablesLock.Lock()
+	defer l.sstablesLock.Unlock()
+
+	for _, sstable := range l.sstables {
+		if sstable.pager != nil {
+			sstable.lock.Lock()
+			errs = append(errs, sstable.pager.Close())
+			sstable.lock.Unlock()
+		}
 	}
 
-	memtSeq := 0
+	return errors.Join(errs...)
+}
 
+// SplitSSTable splits a compacted SSTable into n smaller SSTables of equal size.
+func (l *LSMT) SplitSSTable(sstable *SSTable, n int) ([]*SSTable, error) {
 	if sstable == nil {
 		return nil, nil
 
 	}
 
+	memtable := l.newMemtable()
+
 	// Get an iterator for the SSTable file.
 	it, err := getSSTableIterator(sstable.pager)
 	if err != nil {
@@ -718,225 +1660,218 @@ func (l *LSMT) SplitSSTable(sstable *SSTable, n int) ([]*SSTable, error) {
 		}
 
 		// If the value is a tombstone, skip this key-value pair.
-		if bytes.Compare(kv.Value, []byte(TOMBSTONE_VALUE)) == 0 {
+		if kv.isTombstone() {
 			continue
 		}
 
 		// If the value is not a tombstone, add it to the memtable.
-		if memtSeq < len(memTables) {
-			memTables[memtSeq].Insert(kv.Key, kv.Value)
-
-			// If we have reached the size of the memtable, flush it to disk.
-			if memTables[memtSeq].GetSize() >= l.memtableFlushSize {
-				memtSeq++
-			}
+		err = insertKv(memtable, kv)
+		if err != nil {
+			return nil, err
 		}
-
 	}
 
-	// Close the SSTable pager.
-	sstable.pager.Close()
-
-	// delete the sstable file
-	err = os.Remove(sstable.pager.file.Name())
+	// The SSTable is removed once the SSTables it is split into are synced, they keep its range tombstones as they may cover keys of older SSTables
+	sstables, err := l.splitMemtable(memtable, sstable.rangeTombstones, n)
 	if err != nil {
 		return nil, err
 	}
 
-	sstables := make([]*SSTable, n)
-
-	for i := 0; i < n; i++ {
-		sst, err := l.newSSTable(l.directory, memTables[i])
-		if err != nil {
-			return nil, err
-		}
-
-		if sst == nil {
-			continue
-		}
-
-		sstables[i] = sst
-	}
-
-	return sstables, nil
+	return sstables, l.removeSSTables([]*SSTable{sstable})
 }
 
-// Range retrieves all key-value pairs within a given range from the LSM-tree.
-func (l *LSMT) Range(start, end []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
+// splitMemtable flushes the memtable and its range tombstones to disk as n SSTables holding an equal share of its keys.
+// Fewer SSTables are created if the memtable has fewer than n keys.
+// The keys a range tombstone covers stay in the SSTable holding the range tombstone, so it never hides a key of the memtable written after it.
+func (l *LSMT) splitMemtable(memtable Memtable, rangeTombstones []*rangeTombstone, n int) ([]*SSTable, error) {
+	var keys, values [][]byte
 
-	// Check if we are flushing or compacting
-	l.cond.L.Lock()
-	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
-		l.cond.Wait()
+	ascend(memtable, nil, func(key, value []byte) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+
+	total := len(keys)
+	if n > total {
+		n = total
 	}
-	l.cond.L.Unlock()
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
+	// A range tombstone without keys is still written
+	parts := make([]Memtable, 1, max(n, 1))
+	parts[0] = l.newMemtable()
 
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
+	// partOf holds the part of every key
+	partOf := make([]int, total)
 
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, start) >= 0 && bytes.Compare(node.Key, end) <= 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
+	for i := range keys {
+		// The parts differ by at most one key, unless a range tombstone covers the keys on both sides of the split
+		if i > 0 && i*n/total >= len(parts) && !coversBoth(l.comparator, rangeTombstones, keys[i-1], keys[i]) {
+			parts = append(parts, l.newMemtable())
 		}
-	})
 
-	l.memtableLock.RUnlock()
+		partOf[i] = len(parts) - 1
+		parts[partOf[i]].Insert(keys[i], values[i])
+	}
 
-	// Search the SSTables for the range.
-	for i := len(l.sstables) - 1; i >= 0; i-- {
+	// A range tombstone goes with the first key it may cover
+	partTombstones := make([][]*rangeTombstone, len(parts))
+	for _, rt := range rangeTombstones {
+		part := len(parts) - 1
 
-		sstable := l.sstables[i]
+		i, _ := slices.BinarySearchFunc(keys, rt.start, l.comparator.Compare)
+		if i < total {
+			part = partOf[i]
+		}
 
-		sstable.lock.RLock()
+		partTombstones[part] = append(partTombstones[part], rt)
+	}
 
-		// If the range is not within the range of this SSTable, skip it.
-		if bytes.Compare(start, sstable.minKey) < 0 || bytes.Compare(end, sstable.maxKey) > 0 {
-			continue
-		}
+	sstables := make([]*SSTable, 0, len(parts))
 
-		// Get an iterator for the SSTable file.
-		it, err := getSSTableIterator(sstable.pager)
+	for i, part := range parts {
+		sstable, err := l.newSSTable(l.directory, part, partTombstones[i])
 		if err != nil {
-			sstable.lock.RUnlock()
-			return nil, nil, err
+			// The SSTables already written are not published
+			return nil, errors.Join(err, l.removeSSTables(sstables))
 		}
 
-		// Iterate over the SSTable.
-		for it.Ok() {
-			kv, err := it.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sstable.lock.RUnlock()
-				return nil, nil, err
-			}
+		if sstable != nil {
+			sstables = append(sstables, sstable)
+		}
+	}
 
-			if bytes.Compare(kv.Key, start) >= 0 && bytes.Compare(kv.Key, end) <= 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
-			}
+	return sstables, nil
+}
 
+// coversBoth returns whether a range tombstone covers both keys, the first key being less than the second.
+func coversBoth(comparator Comparator, rangeTombstones []*rangeTombstone, first, second []byte) bool {
+	for _, rt := range rangeTombstones {
+		if comparator.Compare(rt.start, first) <= 0 && comparator.Compare(second, rt.end) <= 0 {
+			return true
 		}
-
-		sstable.lock.RUnlock()
 	}
 
-	return keys, values, nil
+	return false
 }
 
-// NRange retrieves all key-value pairs not within a given range from the LSM-tree.
-func (l *LSMT) NRange(start, end []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
+// collect gathers the live key-value pairs whose keys satisfy match, sorted by key.
+// Newer entries shadow older ones and keys hidden by tombstones or range tombstones are left out.
+// SSTables outside of lower and upper are skipped, a nil bound means unbounded.
+func (l *LSMT) collect(lower, upper []byte, match func(key []byte) bool) ([][]byte, [][]byte, error) {
+	var kvs []*KeyValue
+	var rangeTombstones []*rangeTombstone // range tombstones of the sources visited so far
 
-	// Check if we are flushing or compacting
-	l.cond.L.Lock()
-	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
-		l.cond.Wait()
-	}
-	l.cond.L.Unlock()
+	seen := make(map[string]struct{})     // keys whose value is known
+	pending := make(map[string]*KeyValue) // merge records waiting for the older value of their key
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
+	now := time.Now()
+
+	// resolve settles the value of the key given its newest entry which is not a merge record, or nil if there is none.
+	resolve := func(key []byte, kv *KeyValue) error {
+		seen[string(key)] = struct{}{}
 
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
+		merge, ok := pending[string(key)]
+		if !ok {
+			if kv != nil {
+				kvs = append(kvs, kv)
+			}
 
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, start) < 0 || bytes.Compare(node.Key, end) > 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
+			return nil
 		}
-	})
 
-	l.memtableLock.RUnlock()
+		delete(pending, string(key))
 
-	// Search the SSTables for the range.
-	for i := len(l.sstables) - 1; i >= 0; i-- {
+		var existing []byte
+		if kv != nil {
+			existing = kv.Value
+		}
 
-		sstable := l.sstables[i]
+		value, err := l.fullMerge(key, existing, merge.Operands)
+		if err != nil {
+			return err
+		}
 
-		sstable.lock.RLock()
+		kvs = append(kvs, &KeyValue{Key: key, Value: value})
 
-		// If the range is not within the range of this SSTable, skip it.
-		if bytes.Compare(start, sstable.minKey) < 0 || bytes.Compare(end, sstable.maxKey) > 0 {
-			continue
+		return nil
+	}
+
+	visit := func(kv *KeyValue) error {
+		if !match(kv.Key) {
+			return nil
 		}
 
-		// Get an iterator for the SSTable file.
-		it, err := getSSTableIterator(sstable.pager)
-		if err != nil {
-			sstable.lock.RUnlock()
-			return nil, nil, err
+		// The newest entry of a key decides whether it is live
+		if _, ok := seen[string(kv.Key)]; ok {
+			return nil
 		}
 
-		// Iterate over the SSTable.
-		for it.Ok() {
-			kv, err := it.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sstable.lock.RUnlock()
-				return nil, nil, err
-			}
+		if kv.isTombstone() || kv.isExpired(now) || coveredByRangeTombstone(l.comparator, rangeTombstones, kv.Key) {
+			return resolve(kv.Key, nil)
+		}
 
-			if bytes.Compare(kv.Key, start) < 0 || bytes.Compare(kv.Key, end) > 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
+		if kv.isMerge() {
+			// The operands of older entries apply before the ones we have found so far
+			if merge, ok := pending[string(kv.Key)]; ok {
+				merge.Operands = slices.Concat(kv.Operands, merge.Operands)
+			} else {
+				pending[string(kv.Key)] = &KeyValue{Key: kv.Key, Operands: kv.Operands}
 			}
 
+			return nil
 		}
 
-		sstable.lock.RUnlock()
+		return resolve(kv.Key, kv)
 	}
 
-	return keys, values, nil
+	memtable, memtableRangeTombstones, release := l.readMemtable()
 
-}
+	var err error
 
-// GreaterThan retrieves all key-value pairs greater than the key from the LSM-tree.
-func (l *LSMT) GreaterThan(key []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
-
-	// Check if we are flushing or compacting
-	l.cond.L.Lock()
-	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
-		l.cond.Wait()
-	}
-	l.cond.L.Unlock()
-
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
+	ascend(memtable, lower, func(key, value []byte) bool {
+		if upper != nil && l.comparator.Compare(key, upper) > 0 {
+			return false
+		}
 
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
+		if !match(key) {
+			return true
+		}
 
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, key) > 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
+		var kv *KeyValue
+		kv, err = decodeKv(value)
+		if err == nil {
+			err = visit(kv)
 		}
+
+		return err == nil
 	})
 
-	l.memtableLock.RUnlock()
+	release()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rangeTombstones = append(rangeTombstones, memtableRangeTombstones...)
 
-	// Search the SSTables for the range.
+	// Lock sstables for reading.
+	l.sstablesLock.RLock()
+	defer l.sstablesLock.RUnlock()
+
+	// Search the SSTables from the newest to the oldest.
 	for i := len(l.sstables) - 1; i >= 0; i-- {
 
 		sstable := l.sstables[i]
 
 		sstable.lock.RLock()
 
+		// If the SSTable is outside of the bounds, skip it.
+		if (upper != nil && l.comparator.Compare(sstable.minKey, upper) > 0) || (lower != nil && l.comparator.Compare(sstable.maxKey, lower) < 0) {
+			sstable.lock.RUnlock()
+			continue
+		}
+
 		// Get an iterator for the SSTable file.
 		it, err := getSSTableIterator(sstable.pager)
 		if err != nil {
@@ -954,23 +1889,44 @@ func (l *LSMT) GreaterThan(key []byte) ([][]byte, [][]byte, error) {
 				return nil, nil, err
 			}
 
-			if bytes.Compare(kv.Key, key) > 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
+			err = visit(kv)
+			if err != nil {
+				sstable.lock.RUnlock()
+				return nil, nil, err
 			}
-
 		}
 
+		rangeTombstones = append(rangeTombstones, sstable.rangeTombstones...)
+
 		sstable.lock.RUnlock()
 	}
 
+	// Merge records without an older value are folded on their own
+	for _, merge := range pending {
+		err = resolve(merge.Key, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	slices.SortFunc(kvs, func(a, b *KeyValue) int {
+		return l.comparator.Compare(a.Key, b.Key)
+	})
+
+	keys := make([][]byte, 0, len(kvs))
+	values := make([][]byte, 0, len(kvs))
+
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+		values = append(values, kv.Value)
+	}
+
 	return keys, values, nil
 }
 
-// GreaterThanEqual retrieves all key-value pairs greater than or equal to the key from the LSM-tree.
-func (l *LSMT) GreaterThanEqual(key []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
+// Range retrieves all key-value pairs within a given range from the LSM-tree.
+func (l *LSMT) Range(start, end []byte) ([][]byte, [][]byte, error) {
+	// We will check the memtable and the SSTables for the range.
 
 	// Check if we are flushing or compacting
 	l.cond.L.Lock()
@@ -979,62 +1935,62 @@ func (l *LSMT) GreaterThanEqual(key []byte) ([][]byte, [][]byte, error) {
 	}
 	l.cond.L.Unlock()
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
-
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
-
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, key) >= 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
-		}
+	return l.collect(start, end, func(key []byte) bool {
+		return l.comparator.Compare(key, start) >= 0 && l.comparator.Compare(key, end) <= 0
 	})
+}
 
-	l.memtableLock.RUnlock()
+// NRange retrieves all key-value pairs not within a given range from the LSM-tree.
+func (l *LSMT) NRange(start, end []byte) ([][]byte, [][]byte, error) {
+	// We will check the memtable and the SSTables for the range.
 
-	// Search the SSTables for the range.
-	for i := len(l.sstables) - 1; i >= 0; i-- {
+	// Check if we are flushing or compacting
+	l.cond.L.Lock()
+	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
+		l.cond.Wait()
+	}
+	l.cond.L.Unlock()
 
-		sstable := l.sstables[i]
+	return l.collect(nil, nil, func(key []byte) bool {
+		return l.comparator.Compare(key, start) < 0 || l.comparator.Compare(key, end) > 0
+	})
+}
 
-		sstable.lock.RLock()
+// GreaterThan retrieves all key-value pairs greater than the key from the LSM-tree.
+func (l *LSMT) GreaterThan(key []byte) ([][]byte, [][]byte, error) {
+	// We will check the memtable and the SSTables for the range.
 
-		// Get an iterator for the SSTable file.
-		it, err := getSSTableIterator(sstable.pager)
-		if err != nil {
-			sstable.lock.RUnlock()
-			return nil, nil, err
-		}
+	// Check if we are flushing or compacting
+	l.cond.L.Lock()
+	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
+		l.cond.Wait()
+	}
+	l.cond.L.Unlock()
 
-		// Iterate over the SSTable.
-		for it.Ok() {
-			kv, err := it.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sstable.lock.RUnlock()
-				return nil, nil, err
-			}
+	return l.collect(key, nil, func(k []byte) bool {
+		return l.comparator.Compare(k, key) > 0
+	})
+}
 
-			if bytes.Compare(kv.Key, key) >= 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
-			}
+// GreaterThanEqual retrieves all key-value pairs greater than or equal to the key from the LSM-tree.
+func (l *LSMT) GreaterThanEqual(key []byte) ([][]byte, [][]byte, error) {
+	// We will check the memtable and the SSTables for the range.
 
-		}
-		sstable.lock.RUnlock()
+	// Check if we are flushing or compacting
+	l.cond.L.Lock()
+	for l.isFlushing.Load() == 1 || l.isCompacting.Load() == 1 {
+		l.cond.Wait()
 	}
+	l.cond.L.Unlock()
 
-	return keys, values, nil
+	return l.collect(key, nil, func(k []byte) bool {
+		return l.comparator.Compare(k, key) >= 0
+	})
 }
 
 // LessThan retrieves all key-value pairs less than the key from the LSM-tree.
 func (l *LSMT) LessThan(key []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
+	// We will check the memtable and the SSTables for the range.
 
 	// Check if we are flushing or compacting
 	l.cond.L.Lock()
@@ -1043,63 +1999,14 @@ func (l *LSMT) LessThan(key []byte) ([][]byte, [][]byte, error) {
 	}
 	l.cond.L.Unlock()
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
-
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
-
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, key) < 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
-		}
+	return l.collect(nil, key, func(k []byte) bool {
+		return l.comparator.Compare(k, key) < 0
 	})
-
-	l.memtableLock.RUnlock()
-
-	// Search the SSTables for the range.
-	for i := len(l.sstables) - 1; i >= 0; i-- {
-
-		sstable := l.sstables[i]
-
-		sstable.lock.RLock()
-
-		// Get an iterator for the SSTable file.
-		it, err := getSSTableIterator(sstable.pager)
-		if err != nil {
-			sstable.lock.RUnlock()
-			return nil, nil, err
-		}
-
-		// Iterate over the SSTable.
-		for it.Ok() {
-			kv, err := it.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sstable.lock.RUnlock()
-				return nil, nil, err
-			}
-
-			if bytes.Compare(kv.Key, key) < 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
-			}
-
-		}
-
-		sstable.lock.RUnlock()
-	}
-
-	return keys, values, nil
 }
 
 // LessThanEqual retrieves all key-value pairs less than or equal to the key from the LSM-tree.
 func (l *LSMT) LessThanEqual(key []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
+	// We will check the memtable and the SSTables for the range.
 
 	// Check if we are flushing or compacting
 	l.cond.L.Lock()
@@ -1108,62 +2015,14 @@ func (l *LSMT) LessThanEqual(key []byte) ([][]byte, [][]byte, error) {
 	}
 	l.cond.L.Unlock()
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
-
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
-
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, key) <= 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
-		}
+	return l.collect(nil, key, func(k []byte) bool {
+		return l.comparator.Compare(k, key) <= 0
 	})
-
-	l.memtableLock.RUnlock()
-
-	// Search the SSTables for the range.
-	for i := len(l.sstables) - 1; i >= 0; i-- {
-
-		sstable := l.sstables[i]
-
-		sstable.lock.RLock()
-
-		// Get an iterator for the SSTable file.
-		it, err := getSSTableIterator(sstable.pager)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		// Iterate over the SSTable.
-		for it.Ok() {
-			kv, err := it.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sstable.lock.RUnlock()
-				return nil, nil, err
-			}
-
-			if bytes.Compare(kv.Key, key) <= 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
-			}
-
-		}
-
-		sstable.lock.RUnlock()
-	}
-
-	return keys, values, nil
 }
 
 // NGet retrieves all key-value pairs not equal to the key from the LSM-tree.
 func (l *LSMT) NGet(key []byte) ([][]byte, [][]byte, error) {
-	// We will first check the memtable for the range.
-	// If the range is not found in the memtable, we will search the SSTables.
+	// We will check the memtable and the SSTables for the range.
 
 	// Check if we are flushing or compacting
 	l.cond.L.Lock()
@@ -1172,56 +2031,9 @@ func (l *LSMT) NGet(key []byte) ([][]byte, [][]byte, error) {
 	}
 	l.cond.L.Unlock()
 
-	// Lock memtable for reading.
-	l.memtableLock.RLock()
-
-	// Check the memtable for the range.
-	var keys [][]byte
-	var values [][]byte
-
-	l.memtable.InOrderTraversal(func(node *avl.Node) {
-		if bytes.Compare(node.Key, key) != 0 {
-			keys = append(keys, node.Key)
-			values = append(values, node.Value)
-		}
+	return l.collect(nil, nil, func(k []byte) bool {
+		return l.comparator.Compare(k, key) != 0
 	})
-
-	l.memtableLock.RUnlock()
-
-	// Search the SSTables for the range.
-	for i := len(l.sstables) - 1; i >= 0; i-- {
-
-		sstable := l.sstables[i]
-
-		sstable.lock.RLock()
-
-		// Get an iterator for the SSTable file.
-		it, err := getSSTableIterator(sstable.pager)
-		if err != nil {
-			sstable.lock.RUnlock()
-			return nil, nil, err
-		}
-
-		// Iterate over the SSTable.
-		for it.Ok() {
-			kv, err := it.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sstable.lock.RUnlock()
-				return nil, nil, err
-			}
-
-			if bytes.Compare(kv.Key, key) != 0 {
-				keys = append(keys, kv.Key)
-				values = append(values, kv.Value)
-			}
-		}
-
-		sstable.lock.RUnlock()
-	}
-
-	return keys, values, nil
 }
 
 // BeginTransaction starts a new transaction.
@@ -1241,6 +2053,16 @@ func (tx *Transaction) AddDelete(key []byte) {
 	tx.Operations = append(tx.Operations, Operation{Type: OpDelete, Key: key})
 }
 
+// AddDeleteRange adds a range delete operation to a transaction.
+func (tx *Transaction) AddDeleteRange(start, end []byte) {
+	tx.Operations = append(tx.Operations, Operation{Type: OpDeleteRange, Key: start, End: end})
+}
+
+// AddMerge adds a merge operation to a transaction.
+func (tx *Transaction) AddMerge(key, operand []byte) {
+	tx.Operations = append(tx.Operations, Operation{Type: OpMerge, Key: key, Value: operand})
+}
+
 // CommitTransaction commits a transaction.
 func (l *LSMT) CommitTransaction(tx *Transaction) error {
 	if tx.Aborted {
@@ -1257,6 +2079,14 @@ func (l *LSMT) CommitTransaction(tx *Transaction) error {
 			if err := l.Delete(op.Key); err != nil {
 				return err
 			}
+		case OpDeleteRange:
+			if err := l.DeleteRange(op.Key, op.End); err != nil {
+				return err
+			}
+		case OpMerge:
+			if err := l.Merge(op.Key, op.Value); err != nil {
+				return err
+			}
 		}
 	}
 
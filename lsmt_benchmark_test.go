@@ -18,6 +18,7 @@ package lsmt
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 	"testing"
 )
 
@@ -61,3 +62,33 @@ func BenchmarkDelete(b *testing.B) {
 		lsmt.Delete([]byte(fmt.Sprintf("%d", i%10000)))
 	}
 }
+
+func BenchmarkPutParallel(b *testing.B) {
+	lsmt, _ := New("my_lsm_tree", 0755, 100_000, 2, 1)
+	defer os.RemoveAll("my_lsm_tree")
+
+	b.ResetTimer()
+
+	i := atomic.Int64{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := i.Add(1)
+			lsmt.Put([]byte(fmt.Sprintf("%d", n)), []byte(fmt.Sprintf("%d", n)))
+		}
+	})
+}
+
+func BenchmarkPutParallelSkipList(b *testing.B) {
+	lsmt, _ := New("my_lsm_tree", 0755, 100_000, 2, 1, WithMemtable(NewSkipListMemtable))
+	defer os.RemoveAll("my_lsm_tree")
+
+	b.ResetTimer()
+
+	i := atomic.Int64{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := i.Add(1)
+			lsmt.Put([]byte(fmt.Sprintf("%d", n)), []byte(fmt.Sprintf("%d", n)))
+		}
+	})
+}
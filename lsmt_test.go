@@ -16,12 +16,17 @@
 package lsmt
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -718,6 +723,231 @@ func TestLSMT_WalAndRecovery(t *testing.T) {
 
 }
 
+func TestLSMT_CloseWaitsForReaders(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(10), WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 25; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		err = lsmt.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A reader is in the middle of reading the memory-mapped SSTable
+	sstable := lsmt.sstables[0]
+	sstable.lock.RLock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- lsmt.Close()
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("expected Close to wait for the reader, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The map is still readable
+	_, err = sstable.pager.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sstable.lock.RUnlock()
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLSMT_CloseErrors(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 25; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		err = lsmt.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first SSTable fails to close, the other files are closed all the same
+	err = lsmt.sstables[0].pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Close()
+	if err == nil {
+		t.Fatal("expected error closing the first SSTable")
+	}
+
+	if !errors.Is(lsmt.wal.pager.file.Close(), os.ErrClosed) {
+		t.Fatal("expected the write-ahead log to be closed")
+	}
+
+	for _, sstable := range lsmt.sstables {
+		if !errors.Is(sstable.pager.file.Close(), os.ErrClosed) {
+			t.Fatalf("expected %s to be closed", sstable.pager.file.Name())
+		}
+	}
+}
+
+func TestLSMT_WalTruncation(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(100), WithCompactionInterval(100), WithWalTruncation())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1005; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		err = lsmt.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The write-ahead log only holds the operations of the memtable
+	if lsmt.GetWal().pager.PagesCount() > 100 {
+		t.Fatalf("expected at most 100 pages in the write-ahead log, got %d", lsmt.GetWal().pager.PagesCount())
+	}
+
+	// Crash, losing the memtable
+	err = lsmt.wal.pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = Open("test_lsm_tree", WithMemtableFlushSize(100), WithCompactionInterval(100), WithWalTruncation())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operations, err := lsmt.GetWal().Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) == 0 || len(operations) > 100 {
+		t.Fatalf("expected the unflushed operations only, got %d", len(operations))
+	}
+
+	err = lsmt.RunRecoveredOperations(operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 500, 1004} {
+		key := fmt.Sprintf("%04d", i)
+
+		value, err := lsmt.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != key {
+			t.Fatalf("expected %s, got %s", key, value)
+		}
+	}
+
+	// Closing flushes the memtable, leaving nothing to recover
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = Open("test_lsm_tree", WithMemtableFlushSize(100), WithCompactionInterval(100), WithWalTruncation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmt.Close()
+
+	operations, err = lsmt.GetWal().Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) != 0 {
+		t.Fatalf("expected no operations to recover, got %d", len(operations))
+	}
+}
+
+func TestLSMT_WalTornTail(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 100, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		err = lsmt.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wal := lsmt.GetWal()
+
+	// A crash tears the write of the last operation
+	_, err = wal.pager.file.WriteAt([]byte("torn"), wal.pager.offset(4)+HEADER_SIZE+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operations, err := wal.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) != 4 || string(operations[3].Key) != "key3" {
+		t.Fatalf("expected the 4 operations before the torn page, got %d", len(operations))
+	}
+
+	// The next operations are logged in place of the torn page
+	err = lsmt.Put([]byte("key5"), []byte("key5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operations, err = wal.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) != 5 || string(operations[4].Key) != "key5" {
+		t.Fatalf("expected 5 operations ending with key5, got %d", len(operations))
+	}
+
+	// Corruption in the middle of the log is not a torn write
+	_, err = wal.pager.file.WriteAt([]byte("corrupt"), wal.pager.offset(1)+HEADER_SIZE+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wal.Recover()
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("expected ErrCorruptPage, got %v", err)
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestLSMT_Concurrent(t *testing.T) {
 	defer os.RemoveAll("test_lsm_tree")
 	lsmt, err := New("test_lsm_tree", 0755, 1000, 2, 1)
@@ -834,3 +1064,900 @@ func TestLSMT_Concurrent3(t *testing.T) {
 		}
 	}
 }
+
+func TestLSMT_DeleteRange(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys 100 to 149, some of them will be flushed to SSTables
+	for i := 100; i < 150; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = lsmt.DeleteRange([]byte("110"), []byte("139"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A put after the range delete is not hidden by it
+	err = lsmt.Put([]byte("120"), []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		for i := 100; i < 150; i++ {
+			value, err := lsmt.Get([]byte(fmt.Sprintf("%d", i)))
+			switch {
+			case i == 120:
+				if err != nil || string(value) != "new" {
+					t.Fatalf("expected new, got %s (%v)", string(value), err)
+				}
+			case i >= 110 && i <= 139:
+				if err == nil {
+					t.Fatalf("expected key %d to be deleted, got %s", i, string(value))
+				}
+			default:
+				if err != nil || string(value) != fmt.Sprintf("%d", i) {
+					t.Fatalf("expected %d, got %s (%v)", i, string(value), err)
+				}
+			}
+		}
+
+		keys, _, err := lsmt.Range([]byte("100"), []byte("149"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 21 {
+			t.Fatalf("expected 21 keys, got %d", len(keys))
+		}
+	}
+
+	check()
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The range tombstone is persisted in the SSTables
+	lsmt, err = New("test_lsm_tree", 0755, 10, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	check()
+
+	// Compaction drops the covered keys
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+
+	for _, sstable := range lsmt.sstables {
+		if len(sstable.rangeTombstones) != 0 {
+			t.Fatalf("expected range tombstones to be dropped on compaction")
+		}
+	}
+}
+
+func TestLSMT_SplitSSTableRangeTombstones(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 100, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	flush := func() {
+		lsmt.memtableLock.Lock()
+		defer lsmt.memtableLock.Unlock()
+
+		err := lsmt.flushMemtable()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put := func(key, value string) {
+		err := lsmt.Put([]byte(key), []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The older SSTable holds the keys the range tombstone deletes
+	for i := 0; i < 10; i++ {
+		put(fmt.Sprintf("k%02d", i), fmt.Sprintf("k%02d", i))
+	}
+
+	flush()
+
+	// The newer SSTable holds the range tombstone and keys put after it, some of them in its range
+	err = lsmt.DeleteRange([]byte("k03"), []byte("k06"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put("k04", "new")
+	put("k05", "new")
+
+	for i := 0; i < 5; i++ {
+		put(fmt.Sprintf("x%02d", i), fmt.Sprintf("x%02d", i))
+	}
+
+	flush()
+
+	sstables, err := lsmt.SplitSSTable(lsmt.sstables[1], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys covered by the range tombstone are not split apart
+	if len(sstables) != 6 {
+		t.Fatalf("expected 6 sstables, got %d", len(sstables))
+	}
+
+	lsmt.sstables = append(lsmt.sstables[:1], sstables...)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%02d", i)
+
+		value, err := lsmt.Get([]byte(key))
+		switch {
+		case i == 4 || i == 5:
+			if err != nil || string(value) != "new" {
+				t.Fatalf("expected new for %s, got %s (%v)", key, value, err)
+			}
+		case i >= 3 && i <= 6:
+			if err == nil {
+				t.Fatalf("expected %s to be deleted, got %s", key, value)
+			}
+		default:
+			if err != nil || string(value) != key {
+				t.Fatalf("expected %s, got %s (%v)", key, value, err)
+			}
+		}
+	}
+
+	keys, _, err := lsmt.Range([]byte("k00"), []byte("k09"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 8 {
+		t.Fatalf("expected 8 keys, got %d", len(keys))
+	}
+}
+
+func TestLSMT_DeleteRangeTransaction(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 128, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	tx := lsmt.BeginTransaction()
+	tx.AddPut([]byte("tenant1/a"), []byte("1"))
+	tx.AddPut([]byte("tenant1/b"), []byte("2"))
+	tx.AddPut([]byte("tenant2/a"), []byte("3"))
+	tx.AddDeleteRange([]byte("tenant1/"), []byte("tenant1/~"))
+
+	err = lsmt.CommitTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _, err := lsmt.GreaterThanEqual([]byte("tenant"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || string(keys[0]) != "tenant2/a" {
+		t.Fatalf("expected only tenant2/a, got %d keys", len(keys))
+	}
+}
+
+func TestLSMT_PutWithTTL(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 30; i++ {
+		if i%2 == 0 {
+			err = lsmt.PutWithTTL([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)), 50*time.Millisecond)
+		} else {
+			err = lsmt.Put([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("%d", i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := lsmt.Get([]byte("4"))
+	if err != nil || string(value) != "4" {
+		t.Fatalf("expected 4, got %s (%v)", string(value), err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Expired keys are hidden from reads
+	value, err = lsmt.Get([]byte("4"))
+	if err == nil {
+		t.Fatalf("expected key 4 to be expired, got %s", string(value))
+	}
+
+	keys, _, err := lsmt.GreaterThanEqual([]byte("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 15 {
+		t.Fatalf("expected 15 keys, got %d", len(keys))
+	}
+
+	// Compaction removes the expired keys from the SSTables
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sstable := range lsmt.sstables {
+		it, err := getSSTableIterator(sstable.pager)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for it.Ok() {
+			kv, err := it.Next()
+			if err != nil {
+				break
+			}
+
+			if kv.Expires != 0 {
+				t.Fatalf("expected expired key %s to be compacted away", string(kv.Key))
+			}
+		}
+	}
+
+	err = lsmt.PutWithTTL([]byte("key"), []byte("value"), 0)
+	if err == nil {
+		t.Fatal("expected error for a ttl of 0")
+	}
+}
+
+func TestLSMT_DefaultTTL(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 128, 2, 1, WithDefaultTTL(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	err = lsmt.Put([]byte("session"), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := lsmt.Get([]byte("session"))
+	if err != nil || string(value) != "data" {
+		t.Fatalf("expected data, got %s (%v)", string(value), err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	value, err = lsmt.Get([]byte("session"))
+	if err == nil {
+		t.Fatalf("expected session to be expired, got %s", string(value))
+	}
+}
+
+// counterMergeOperator adds decimal operands to a decimal counter.
+type counterMergeOperator struct{}
+
+func (counterMergeOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var counter int64
+	if existing != nil {
+		var err error
+		counter, err = strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(string(operand), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counter += n
+	}
+
+	return []byte(strconv.FormatInt(counter, 10)), nil
+}
+
+func TestLSMT_Merge(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1, WithMergeOperator(counterMergeOperator{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Put([]byte("counter"), []byte("100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Other keys make the memtable flush in between the merges
+			err := lsmt.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+			if err != nil {
+				t.Errorf("Put operation failed: %v", err)
+			}
+
+			err = lsmt.Merge([]byte("counter"), []byte("1"))
+			if err != nil {
+				t.Errorf("Merge operation failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(expect string) {
+		value, err := lsmt.Get([]byte("counter"))
+		if err != nil || string(value) != expect {
+			t.Fatalf("expected %s, got %s (%v)", expect, string(value), err)
+		}
+
+		keys, values, err := lsmt.LessThanEqual([]byte("counter"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 1 || string(values[0]) != expect {
+			t.Fatalf("expected counter to be %s in range queries", expect)
+		}
+	}
+
+	check("150")
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = New("test_lsm_tree", 0755, 10, 100, 1, WithMergeOperator(counterMergeOperator{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	err = lsmt.Merge([]byte("counter"), []byte("-50"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("100")
+
+	// Compaction folds the merge records into a single value
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("100")
+
+	// Merging into a deleted key starts from no value
+	err = lsmt.Delete([]byte("counter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Merge([]byte("counter"), []byte("7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("7")
+}
+
+func TestLSMT_MergeRecovery(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	open := func() *LSMT {
+		lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1, WithMergeOperator(counterMergeOperator{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return lsmt
+	}
+
+	replay := func(lsmt *LSMT, expect string) {
+		operations, err := lsmt.GetWal().Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages := lsmt.GetWal().pager.PagesCount()
+
+		err = lsmt.RunRecoveredOperations(operations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Replaying does not log the operations again
+		if lsmt.GetWal().pager.PagesCount() != pages {
+			t.Fatalf("expected %d pages in the write-ahead log, got %d", pages, lsmt.GetWal().pager.PagesCount())
+		}
+
+		value, err := lsmt.Get([]byte("counter"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != expect {
+			t.Fatalf("expected %s, got %s", expect, value)
+		}
+	}
+
+	lsmt := open()
+
+	for i := 0; i < 3; i++ {
+		err := lsmt.Merge([]byte("counter"), []byte("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closing flushes the merges, recovering does not apply them again
+	err := lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt = open()
+	replay(lsmt, "3")
+
+	for i := 0; i < 2; i++ {
+		err = lsmt.Merge([]byte("counter"), []byte("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crash, losing the memtable, the merges after the flush are applied once
+	err = lsmt.wal.pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt = open()
+	defer lsmt.Close()
+
+	replay(lsmt, "5")
+}
+
+// failingMergeOperator is a counterMergeOperator which fails once told to.
+type failingMergeOperator struct {
+	fail *atomic.Bool
+}
+
+func (o failingMergeOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if o.fail.Load() {
+		return nil, errors.New("merge failed")
+	}
+
+	return counterMergeOperator{}.FullMerge(key, existing, operands)
+}
+
+func TestLSMT_CompactError(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	fail := &atomic.Bool{}
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1, WithMergeOperator(failingMergeOperator{fail: fail}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The merge record is in a newer SSTable than the keys, it fails after they are read
+	for i := 0; i < 40; i++ {
+		if i == 30 {
+			err = lsmt.Merge([]byte("counter"), []byte("1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		key := []byte(fmt.Sprintf("key%02d", i))
+		err = lsmt.Put(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sstables := len(lsmt.sstables)
+
+	// A compaction which fails keeps the SSTables it was compacting
+	fail.Store(true)
+
+	err = lsmt.Compact()
+	if err == nil {
+		t.Fatal("expected compaction to fail")
+	}
+
+	fail.Store(false)
+
+	if len(lsmt.sstables) != sstables {
+		t.Fatalf("expected %d sstables, got %d", sstables, len(lsmt.sstables))
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = New("test_lsm_tree", 0755, 10, 100, 1, WithMergeOperator(failingMergeOperator{fail: fail}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmt.Close()
+
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir("test_lsm_tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), SSTABLE_EXTENSION) {
+			count++
+		}
+	}
+
+	if count != len(lsmt.sstables) {
+		t.Fatalf("expected the compacted sstable files to be removed, got %d files for %d sstables", count, len(lsmt.sstables))
+	}
+
+	value, err := lsmt.Get([]byte("counter"))
+	if err != nil || string(value) != "1" {
+		t.Fatalf("expected 1, got %s (%v)", value, err)
+	}
+
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key%02d", i)
+
+		value, err = lsmt.Get([]byte(key))
+		if err != nil || string(value) != key {
+			t.Fatalf("expected %s, got %s (%v)", key, value, err)
+		}
+	}
+}
+
+func TestLSMT_MergeWithoutOperator(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 128, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	err = lsmt.Merge([]byte("counter"), []byte("1"))
+	if err == nil {
+		t.Fatal("expected error without a merge operator")
+	}
+}
+
+// tenantCompactionFilter drops the keys of tenant1 and upgrades v1 values to v2.
+type tenantCompactionFilter struct{}
+
+func (tenantCompactionFilter) Filter(key, value []byte) (CompactionDecision, []byte) {
+	if strings.HasPrefix(string(key), "tenant1/") {
+		return CompactionRemove, nil
+	}
+
+	if strings.HasPrefix(string(value), "v1:") {
+		return CompactionChangeValue, []byte("v2:" + strings.TrimPrefix(string(value), "v1:"))
+	}
+
+	return CompactionKeep, nil
+}
+
+func TestLSMT_CompactionFilter(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1, WithCompactionFilter(tenantCompactionFilter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 10; i++ {
+		for _, tenant := range []string{"tenant1", "tenant2"} {
+			err = lsmt.Put([]byte(fmt.Sprintf("%s/%d", tenant, i)), []byte(fmt.Sprintf("v1:%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = lsmt.Put([]byte("tenant3/0"), []byte("v2:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Delete([]byte("tenant2/9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flush the memtable so every key is compacted
+	err = lsmt.flushMemtable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, values, err := lsmt.GreaterThan([]byte("tenant"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+
+	for i, key := range keys {
+		if strings.HasPrefix(string(key), "tenant1/") {
+			t.Fatalf("expected %s to be removed", string(key))
+		}
+
+		if !strings.HasPrefix(string(values[i]), "v2:") {
+			t.Fatalf("expected %s to be rewritten, got %s", string(key), string(values[i]))
+		}
+	}
+
+	stats := lsmt.CompactionStats()
+	if stats.Compactions != 1 || stats.FilterRemoved != 10 || stats.FilterChanged != 9 || stats.FilterKept != 1 || stats.TombstonesDropped != 1 {
+		t.Fatalf("unexpected compaction stats %+v", stats)
+	}
+}
+
+func TestLSMT_CompactEqualSplit(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 100, 100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 1000; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lsmt.sstables) != 3 {
+		t.Fatalf("expected 3 sstables, got %d", len(lsmt.sstables))
+	}
+
+	// The keys flushed so far are split in equal shares
+	total := int64(0)
+	for _, sstable := range lsmt.sstables {
+		total += sstable.pager.PagesCount()
+	}
+
+	for _, sstable := range lsmt.sstables {
+		if count := sstable.pager.PagesCount(); count < total/3 || count > total/3+1 {
+			t.Fatalf("expected about %d keys per sstable, got %d", total/3, count)
+		}
+	}
+
+	// The sstables hold consecutive key ranges
+	for i := 1; i < len(lsmt.sstables); i++ {
+		if bytes.Compare(lsmt.sstables[i-1].maxKey, lsmt.sstables[i].minKey) >= 0 {
+			t.Fatalf("expected sstable %d to end before sstable %d starts", i-1, i)
+		}
+	}
+}
+
+func TestLSMT_LargeValues(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values of several pages each
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d", i)), 1000+i*100)
+	}
+
+	for i := 0; i < 25; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("%02d", i)), value(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt.sstables) == 0 {
+		t.Fatal("expected the memtable to be flushed")
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The values are read back from the sstables and the write-ahead log after reopening
+	lsmt, err = New("test_lsm_tree", 0755, 10, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmt.Close()
+
+	for i := 0; i < 25; i++ {
+		got, err := lsmt.Get([]byte(fmt.Sprintf("%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, value(i)) {
+			t.Fatalf("expected the value of %02d to be %d bytes, got %d", i, len(value(i)), len(got))
+		}
+	}
+
+	keys, _, err := lsmt.Range([]byte("00"), []byte("24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 25 {
+		t.Fatalf("expected 25 keys, got %d", len(keys))
+	}
+}
+
+func TestLSMT_Mmap(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(100), WithCompactionInterval(4), WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read while writes flush and compact memory-mapped SSTables
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			_, err := lsmt.Get([]byte("key0000"))
+			if err != nil && err.Error() != "key not found" {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sstable := range lsmt.sstables {
+		if sstable.pager.mapping == nil {
+			t.Fatal("expected sstables to be memory-mapped")
+		}
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = Open("test_lsm_tree", WithMemtableFlushSize(100), WithCompactionInterval(4), WithMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmt.Close()
+
+	value, err := lsmt.Get([]byte("key1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "value1234" {
+		t.Fatalf("expected value1234, got %s", value)
+	}
+
+	keys, _, err := lsmt.Range([]byte("key0100"), []byte("key0199"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 100 {
+		t.Fatalf("expected 100 keys, got %d", len(keys))
+	}
+}
+
+func TestLSMT_LegacyFormat(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	err := os.Mkdir("test_lsm_tree", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory written before paged files had a superblock
+	wal := make([]byte, legacyPageSize)
+	copy(wal, "-1")
+
+	err = os.WriteFile("test_lsm_tree"+string(os.PathSeparator)+WAL_EXTENSION, wal, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile("test_lsm_tree"+string(os.PathSeparator)+WAL_EXTENSION+LEGACY_DELETED_PAGES_EXTENSION, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New("test_lsm_tree", 0755, 10, 100, 1)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
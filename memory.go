@@ -0,0 +1,160 @@
+// Package lsmt
+// Memory accounting of memtables
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// rangeTombstoneOverhead is the memory a range tombstone takes besides its start and end keys.
+const rangeTombstoneOverhead = int64(unsafe.Sizeof(rangeTombstone{})) + int64(unsafe.Sizeof(&rangeTombstone{}))
+
+// MemoryBudget caps the memory of the memtables of every LSM-tree sharing it.
+// A write which takes the memtables over the limit flushes the largest memtable sharing the budget, which may belong to another LSM-tree.
+type MemoryBudget struct {
+	limit int64              // The bytes the memtables may take.
+	used  atomic.Int64       // The bytes the memtables take.
+	trees map[*LSMT]struct{} // The open LSM-trees sharing the budget.
+	lock  *sync.Mutex        // Lock for the LSM-trees sharing the budget.
+}
+
+// NewMemoryBudget creates a memory budget of limit bytes to share between LSM-trees with WithMemoryBudget.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit, trees: make(map[*LSMT]struct{}), lock: &sync.Mutex{}}
+}
+
+// Limit returns the bytes the memtables may take.
+func (b *MemoryBudget) Limit() int64 {
+	return b.limit
+}
+
+// Used returns the bytes the memtables sharing the budget take.
+func (b *MemoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// exceeded returns whether the memtables take the limit of the budget or more.
+func (b *MemoryBudget) exceeded() bool {
+	return b.used.Load() >= b.limit
+}
+
+// register adds the LSM-tree to the LSM-trees sharing the budget.
+func (b *MemoryBudget) register(l *LSMT) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trees[l] = struct{}{}
+}
+
+// unregister removes the LSM-tree from the LSM-trees sharing the budget, it is no longer flushed for the others.
+func (b *MemoryBudget) unregister(l *LSMT) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.trees, l)
+}
+
+// registered returns whether the LSM-tree shares the budget.
+func (b *MemoryBudget) registered(l *LSMT) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, ok := b.trees[l]
+	return ok
+}
+
+// largest returns the LSM-tree sharing the budget whose memtable takes the most memory, nil if every memtable is empty.
+func (b *MemoryBudget) largest() *LSMT {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var largest *LSMT
+	for l := range b.trees {
+		if l.memtableSize.Load() == 0 {
+			continue
+		}
+
+		if largest == nil || l.memtableBytes.Load() > largest.memtableBytes.Load() {
+			largest = l
+		}
+	}
+
+	return largest
+}
+
+// memtableInsert inserts the encoded key-value pair into the memtable of the LSM-tree, accounting for the memory it takes.
+// Overwriting a key does not count as a new entry.
+func (l *LSMT) memtableInsert(kv *KeyValue) error {
+	encoded, err := encodeKv(kv)
+	if err != nil {
+		return err
+	}
+
+	_, replaced := l.memtable.Insert(kv.Key, encoded)
+	if !replaced {
+		l.memtableSize.Add(1)
+	}
+
+	l.updateMemory()
+
+	return nil
+}
+
+// updateMemory accounts the memory taken by the memtable and its range tombstones to the LSM-tree and the memory budget.
+func (l *LSMT) updateMemory() {
+	size := l.memtable.ApproximateSize() + l.rangeTombstonesSize
+
+	previous := l.memtableBytes.Swap(size)
+
+	if l.memoryBudget != nil {
+		l.memoryBudget.used.Add(size - previous)
+	}
+}
+
+// memtableFull returns whether the memtable reached its flush size or flush bytes.
+func (l *LSMT) memtableFull() bool {
+	if l.memtableFlushSize > 0 && l.memtableSize.Load() > int64(l.memtableFlushSize) {
+		return true
+	}
+
+	return l.memtableFlushBytes > 0 && l.memtableBytes.Load() >= l.memtableFlushBytes
+}
+
+// flushBudget flushes the largest memtable sharing the memory budget if the budget is exceeded.
+// The memtable flushed may belong to another LSM-tree, the memtable lock of the LSM-tree must not be held.
+func (l *LSMT) flushBudget() error {
+	if l.memoryBudget == nil || !l.memoryBudget.exceeded() {
+		return nil
+	}
+
+	largest := l.memoryBudget.largest()
+	if largest == nil {
+		return nil
+	}
+
+	largest.memtableLock.Lock()
+	defer largest.memtableLock.Unlock()
+
+	// Another writer may have flushed a memtable while we waited for the lock, or the LSM-tree may be closed
+	if !l.memoryBudget.exceeded() || largest.memtableSize.Load() == 0 || !l.memoryBudget.registered(largest) {
+		return nil
+	}
+
+	return largest.flushMemtable()
+}
@@ -0,0 +1,201 @@
+// Package lsmt tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestLSMT_MemtableOverwrite(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	// Overwriting the same key does not grow the memtable
+	for i := 0; i < 100; i++ {
+		err = lsmt.Put([]byte("key"), []byte(fmt.Sprintf("value%03d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt.sstables) != 0 {
+		t.Fatalf("expected no sstables, got %d", len(lsmt.sstables))
+	}
+
+	if lsmt.memtableSize.Load() != 1 {
+		t.Fatalf("expected 1 entry, got %d", lsmt.memtableSize.Load())
+	}
+
+	bytesBefore := lsmt.memtableBytes.Load()
+
+	err = lsmt.Put([]byte("key"), bytes.Repeat([]byte("v"), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if grown := lsmt.memtableBytes.Load() - bytesBefore; grown < 990 || grown > 1000 {
+		t.Fatalf("expected the memtable to grow by the size of the new value, grew %d", grown)
+	}
+
+	err = lsmt.DeleteRange([]byte("a"), []byte("z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The range tombstone replaces the key
+	if lsmt.memtableSize.Load() != 1 {
+		t.Fatalf("expected 1 entry, got %d", lsmt.memtableSize.Load())
+	}
+
+	if lsmt.memtableBytes.Load() >= bytesBefore {
+		t.Fatalf("expected the deleted key to be released, memtable takes %d", lsmt.memtableBytes.Load())
+	}
+}
+
+func TestLSMT_MemoryBudget(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	defer os.RemoveAll("test_lsm_tree2")
+
+	budget := NewMemoryBudget(4096)
+
+	lsmt1, err := Open("test_lsm_tree", WithMemtableFlushSize(0), WithMemtableFlushBytes(0), WithMemoryBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt2, err := Open("test_lsm_tree2", WithMemtableFlushSize(0), WithMemtableFlushBytes(0), WithMemoryBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+
+	// The first tree takes most of the budget without flushing
+	for i := 0; i < 8; i++ {
+		err = lsmt1.Put([]byte(fmt.Sprintf("key%d", i)), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt1.sstables) != 0 {
+		t.Fatalf("expected no sstables, got %d", len(lsmt1.sstables))
+	}
+
+	// The second tree goes over the budget once it holds the largest memtable, which is flushed
+	for i := 0; i < 100 && len(lsmt2.sstables) == 0; i++ {
+		err = lsmt2.Put([]byte(fmt.Sprintf("key%d", i)), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt2.sstables) != 1 {
+		t.Fatalf("expected the second tree to flush, got %d sstables", len(lsmt2.sstables))
+	}
+
+	if budget.Used() != lsmt1.memtableBytes.Load() {
+		t.Fatalf("expected the budget to only hold the first tree, used %d of %d", budget.Used(), lsmt1.memtableBytes.Load())
+	}
+
+	err = lsmt1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if budget.Used() != 0 {
+		t.Fatalf("expected the budget to be released, used %d", budget.Used())
+	}
+}
+
+func TestLSMT_MemoryBudgetFlushesLargest(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	defer os.RemoveAll("test_lsm_tree2")
+
+	budget := NewMemoryBudget(4096)
+
+	lsmt1, err := Open("test_lsm_tree", WithMemtableFlushSize(0), WithMemtableFlushBytes(0), WithMemoryBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt2, err := Open("test_lsm_tree2", WithMemtableFlushSize(0), WithMemtableFlushBytes(0), WithMemoryBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 100)
+
+	// The first tree takes most of the budget without flushing
+	for i := 0; budget.Used() < budget.Limit()*3/4; i++ {
+		err = lsmt1.Put([]byte(fmt.Sprintf("key%d", i)), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second tree goes over the budget with a smaller memtable, the memtable of the first tree is flushed
+	for i := 0; i < 100 && len(lsmt1.sstables) == 0; i++ {
+		err = lsmt2.Put([]byte(fmt.Sprintf("key%d", i)), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt1.sstables) != 1 {
+		t.Fatalf("expected the first tree to flush, got %d sstables", len(lsmt1.sstables))
+	}
+
+	if len(lsmt2.sstables) != 0 {
+		t.Fatalf("expected the second tree not to flush, got %d sstables", len(lsmt2.sstables))
+	}
+
+	if lsmt2.memtableSize.Load() == 0 {
+		t.Fatal("expected the second tree to keep its memtable")
+	}
+
+	if budget.Used() != lsmt2.memtableBytes.Load() {
+		t.Fatalf("expected the budget to only hold the second tree, used %d of %d", budget.Used(), lsmt2.memtableBytes.Load())
+	}
+
+	// A closed tree is no longer flushed for the budget
+	err = lsmt2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if budget.largest() != nil {
+		t.Fatal("expected no memtable to flush for the budget")
+	}
+
+	err = lsmt1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,323 @@
+// Package lsmt
+// Memtable implementations
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"github.com/guycipher/lsmt/avl"
+	"github.com/guycipher/lsmt/skiplist"
+	"sync"
+	"unsafe"
+)
+
+// MemtableReader reads the keys of a memtable.
+type MemtableReader interface {
+	// Get returns the value of the key and whether the key is in the memtable.
+	Get(key []byte) ([]byte, bool)
+
+	// Seek returns an iterator positioned at the first key greater or equal to key, or at the first key if key is nil.
+	Seek(key []byte) MemtableIterator
+}
+
+// Memtable holds the latest writes of an LSM-tree in memory, ordered by key, until they are flushed to an SSTable.
+type Memtable interface {
+	MemtableReader
+
+	// Insert inserts the key with the value, returning the previous value and whether the key was in the memtable.
+	Insert(key, value []byte) ([]byte, bool)
+
+	// Delete removes the key, returning its value and whether the key was in the memtable.
+	// Delete is never called while the memtable is being written or read.
+	Delete(key []byte) ([]byte, bool)
+
+	// ApproximateSize returns the memory taken by the memtable, its keys, values and nodes, in bytes.
+	ApproximateSize() int64
+
+	// Len returns the number of keys in the memtable.
+	Len() int
+
+	// Concurrent returns whether Insert, Get and Seek can be called by many goroutines at once.
+	// The LSM-tree serializes writes to memtables which are not concurrent.
+	Concurrent() bool
+}
+
+// SnapshotMemtable is a memtable which can be read through a snapshot, readers then do not hold the memtable lock while they read.
+type SnapshotMemtable interface {
+	Memtable
+
+	// Snapshot returns a read-only view of the memtable as it is now, later writes to the memtable do not change it.
+	// Snapshot is called by many readers at once, never while the memtable is being written.
+	Snapshot() MemtableReader
+}
+
+// MemtableIterator iterates over the keys of a memtable in order.
+type MemtableIterator interface {
+	// Valid returns whether the iterator is positioned at a key.
+	Valid() bool
+
+	// Key returns the key the iterator is positioned at.
+	Key() []byte
+
+	// Value returns the value of the key the iterator is positioned at.
+	Value() []byte
+
+	// Next moves the iterator to the next key.
+	Next()
+}
+
+// MemtableFactory creates an empty memtable ordering keys with the comparator.
+type MemtableFactory func(comparator Comparator) Memtable
+
+// ascend calls f with every key and value of the memtable from the first key greater or equal to start, in order, until f returns false.
+func ascend(memtable MemtableReader, start []byte, f func(key, value []byte) bool) {
+	for it := memtable.Seek(start); it.Valid(); it.Next() {
+		if !f(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+// avlNodeOverhead is the memory an AVL tree node takes besides its key and value.
+const avlNodeOverhead = int64(unsafe.Sizeof(avl.Node{}))
+
+// avlMemtable is a memtable backed by an AVL tree, it is not concurrent.
+type avlMemtable struct {
+	tree         *avl.AVLTree // The AVL tree holding the keys.
+	size         int          // The number of keys in the AVL tree.
+	mem          int64        // The memory taken by the keys, values and nodes of the AVL tree.
+	snapshot     *avlSnapshot // The snapshot of the AVL tree since its last write, nil if it was written since.
+	snapshotLock *sync.Mutex  // Lock for taking the snapshot, readers take it at once.
+}
+
+// avlSnapshot is a read-only view of an AVL tree memtable.
+type avlSnapshot struct {
+	tree *avl.Snapshot // The snapshot of the AVL tree.
+}
+
+// skipListMemtable is a memtable backed by a lock-free skiplist, it is concurrent.
+type skipListMemtable struct {
+	list *skiplist.SkipList // The skiplist holding the keys.
+}
+
+// skipListMemtableIterator iterates over the keys of a skiplist memtable, skipping deleted keys.
+type skipListMemtableIterator struct {
+	node  *skiplist.Node // The node the iterator is positioned at.
+	value []byte         // The value of the node when the iterator reached it.
+}
+
+// NewAVLMemtable creates a memtable backed by an AVL tree, this is the default memtable.
+func NewAVLMemtable(comparator Comparator) Memtable {
+	return &avlMemtable{tree: avl.NewAVLTreeWithComparator(comparator.Compare), snapshotLock: &sync.Mutex{}}
+}
+
+// Insert inserts the key with the value into the AVL tree.
+func (m *avlMemtable) Insert(key, value []byte) ([]byte, bool) {
+	m.snapshot = nil
+
+	// The node may be shared with a snapshot, the tree copies it before overwriting the value
+	node := m.tree.Search(key)
+	if node != nil {
+		old := node.Value
+		m.tree.Insert(key, value)
+		m.mem += int64(len(value) - len(old))
+		return old, true
+	}
+
+	m.tree.Insert(key, value)
+	m.size++
+	m.mem += avlNodeOverhead + int64(len(key)+len(value))
+
+	return nil, false
+}
+
+// Get returns the value of the key from the AVL tree.
+func (m *avlMemtable) Get(key []byte) ([]byte, bool) {
+	node := m.tree.Search(key)
+	if node == nil {
+		return nil, false
+	}
+
+	return node.Value, true
+}
+
+// Delete removes the key from the AVL tree.
+func (m *avlMemtable) Delete(key []byte) ([]byte, bool) {
+	node := m.tree.Search(key)
+	if node == nil {
+		return nil, false
+	}
+
+	old := node.Value
+
+	m.snapshot = nil
+	m.tree.Delete(key)
+	m.size--
+	m.mem -= avlNodeOverhead + int64(len(key)+len(old))
+
+	return old, true
+}
+
+// Seek returns an iterator over the keys of the AVL tree from the first key greater or equal to key.
+func (m *avlMemtable) Seek(key []byte) MemtableIterator {
+	it := m.tree.Iterator()
+
+	if key == nil {
+		it.SeekToFirst()
+	} else {
+		it.Seek(key)
+	}
+
+	return it
+}
+
+// Snapshot returns a snapshot of the AVL tree, shared by the readers until the tree is written again.
+func (m *avlMemtable) Snapshot() MemtableReader {
+	m.snapshotLock.Lock()
+	defer m.snapshotLock.Unlock()
+
+	if m.snapshot == nil {
+		m.snapshot = &avlSnapshot{tree: m.tree.Snapshot()}
+	}
+
+	return m.snapshot
+}
+
+// ApproximateSize returns the memory taken by the keys, values and nodes of the AVL tree.
+func (m *avlMemtable) ApproximateSize() int64 {
+	return m.mem
+}
+
+// Len returns the number of keys in the AVL tree.
+func (m *avlMemtable) Len() int {
+	return m.size
+}
+
+// Concurrent returns false, the AVL tree has to be written by one goroutine at a time.
+func (m *avlMemtable) Concurrent() bool {
+	return false
+}
+
+// Get returns the value of the key from the snapshot.
+func (s *avlSnapshot) Get(key []byte) ([]byte, bool) {
+	node := s.tree.Search(key)
+	if node == nil {
+		return nil, false
+	}
+
+	return node.Value, true
+}
+
+// Seek returns an iterator over the keys of the snapshot from the first key greater or equal to key.
+func (s *avlSnapshot) Seek(key []byte) MemtableIterator {
+	it := s.tree.Iterator()
+
+	if key == nil {
+		it.SeekToFirst()
+	} else {
+		it.Seek(key)
+	}
+
+	return it
+}
+
+// NewSkipListMemtable creates a memtable backed by a lock-free skiplist which many goroutines can write at once.
+// Keys and values are copied into an arena, deleted keys keep their memory until the memtable is flushed.
+func NewSkipListMemtable(comparator Comparator) Memtable {
+	return &skipListMemtable{list: skiplist.NewSkipListWithComparator(comparator.Compare)}
+}
+
+// Insert inserts the key with the value into the skiplist.
+func (m *skipListMemtable) Insert(key, value []byte) ([]byte, bool) {
+	return m.list.Insert(key, value)
+}
+
+// Get returns the value of the key from the skiplist.
+func (m *skipListMemtable) Get(key []byte) ([]byte, bool) {
+	node := m.list.Search(key)
+	if node == nil {
+		return nil, false
+	}
+
+	return node.Value(), true
+}
+
+// Delete marks the key deleted in the skiplist.
+func (m *skipListMemtable) Delete(key []byte) ([]byte, bool) {
+	return m.list.Delete(key)
+}
+
+// Seek returns an iterator over the keys of the skiplist from the first key greater or equal to key.
+func (m *skipListMemtable) Seek(key []byte) MemtableIterator {
+	var node *skiplist.Node
+	if key == nil {
+		node = m.list.First()
+	} else {
+		node = m.list.Seek(key)
+	}
+
+	it := &skipListMemtableIterator{node: node}
+	it.skipDeleted()
+
+	return it
+}
+
+// ApproximateSize returns the memory taken by the keys, values and nodes of the skiplist.
+func (m *skipListMemtable) ApproximateSize() int64 {
+	return m.list.Size()
+}
+
+// Len returns the number of keys in the skiplist.
+func (m *skipListMemtable) Len() int {
+	return m.list.Len()
+}
+
+// Concurrent returns true, the skiplist can be written by many goroutines at once.
+func (m *skipListMemtable) Concurrent() bool {
+	return true
+}
+
+// skipDeleted moves the iterator past deleted keys, loading the value of the key it stops at.
+func (it *skipListMemtableIterator) skipDeleted() {
+	for it.node != nil {
+		if !it.node.Deleted() {
+			it.value = it.node.Value()
+			return
+		}
+
+		it.node = it.node.Next()
+	}
+}
+
+// Valid returns whether the iterator is positioned at a key.
+func (it *skipListMemtableIterator) Valid() bool {
+	return it.node != nil
+}
+
+// Key returns the key the iterator is positioned at.
+func (it *skipListMemtableIterator) Key() []byte {
+	return it.node.Key
+}
+
+// Value returns the value of the key the iterator is positioned at.
+func (it *skipListMemtableIterator) Value() []byte {
+	return it.value
+}
+
+// Next moves the iterator to the next key.
+func (it *skipListMemtableIterator) Next() {
+	it.node = it.node.Next()
+	it.skipDeleted()
+}
@@ -0,0 +1,566 @@
+// Package lsmt tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"fmt"
+	"hash/maphash"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memtableFactories are the memtable implementations every memtable test runs against.
+var memtableFactories = map[string]MemtableFactory{
+	"avl":      NewAVLMemtable,
+	"skiplist": NewSkipListMemtable,
+}
+
+func TestMemtable(t *testing.T) {
+	for name, factory := range memtableFactories {
+		m := factory(BytewiseComparator)
+
+		for i := 9; i >= 0; i-- {
+			if _, replaced := m.Insert([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); replaced {
+				t.Fatalf("%s: expected key%d to be new", name, i)
+			}
+		}
+
+		old, replaced := m.Insert([]byte("key3"), []byte("value"))
+		if !replaced || string(old) != "value3" {
+			t.Fatalf("%s: expected value3 to be replaced, got %s", name, old)
+		}
+
+		value, ok := m.Get([]byte("key3"))
+		if !ok || string(value) != "value" {
+			t.Fatalf("%s: expected value, got %s", name, value)
+		}
+
+		old, deleted := m.Delete([]byte("key5"))
+		if !deleted || string(old) != "value5" {
+			t.Fatalf("%s: expected key5 to be deleted", name)
+		}
+
+		if _, ok := m.Get([]byte("key5")); ok {
+			t.Fatalf("%s: expected key5 not to be found", name)
+		}
+
+		if m.Len() != 9 {
+			t.Fatalf("%s: expected 9 keys, got %d", name, m.Len())
+		}
+
+		var keys []string
+		ascend(m, nil, func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return len(keys) < 5
+		})
+
+		expected := []string{"key0", "key1", "key2", "key3", "key4"}
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Fatalf("%s: expected %v, got %v", name, expected, keys)
+		}
+
+		// Seek skips the deleted key5
+		it := m.Seek([]byte("key41"))
+		if !it.Valid() || string(it.Key()) != "key6" || string(it.Value()) != "value6" {
+			t.Fatalf("%s: expected to seek to key6", name)
+		}
+
+		it.Next()
+		if !it.Valid() || string(it.Key()) != "key7" {
+			t.Fatalf("%s: expected key7 after key6", name)
+		}
+
+		if m.Seek([]byte("key99")).Valid() {
+			t.Fatalf("%s: expected nothing after key9", name)
+		}
+	}
+}
+
+func TestMemtable_ApproximateSize(t *testing.T) {
+	for name, factory := range memtableFactories {
+		m := factory(BytewiseComparator)
+
+		if m.ApproximateSize() != 0 {
+			t.Fatalf("%s: expected an empty memtable to take no memory, got %d", name, m.ApproximateSize())
+		}
+
+		m.Insert([]byte("key"), make([]byte, 1000))
+
+		size := m.ApproximateSize()
+		if size < 1003 {
+			t.Fatalf("%s: expected at least the key and value to be accounted, got %d", name, size)
+		}
+
+		m.Insert([]byte("key2"), make([]byte, 1000))
+		if m.ApproximateSize() < size+1004 {
+			t.Fatalf("%s: expected the memtable to grow, got %d", name, m.ApproximateSize())
+		}
+	}
+}
+
+func TestMemtable_Snapshot(t *testing.T) {
+	m := NewAVLMemtable(BytewiseComparator).(SnapshotMemtable)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		m.Insert(key, key)
+	}
+
+	snapshot := m.Snapshot()
+
+	// Readers share the snapshot until the memtable is written
+	if m.Snapshot() != snapshot {
+		t.Fatal("expected the snapshot to be reused")
+	}
+
+	// Overwriting a key does not change the value in the snapshot
+	m.Insert([]byte("050"), []byte("new"))
+	m.Delete([]byte("051"))
+	m.Insert([]byte("100"), []byte("100"))
+
+	value, ok := snapshot.Get([]byte("050"))
+	if !ok || string(value) != "050" {
+		t.Fatalf("expected 050 in the snapshot, got %s", value)
+	}
+
+	if _, ok := snapshot.Get([]byte("051")); !ok {
+		t.Fatal("expected 051 to remain in the snapshot")
+	}
+
+	n := 0
+	ascend(snapshot, nil, func(key, value []byte) bool {
+		if string(key) != string(value) {
+			t.Fatalf("expected %s to have its own value in the snapshot, got %s", key, value)
+		}
+		n++
+		return true
+	})
+
+	if n != 100 {
+		t.Fatalf("expected 100 keys in the snapshot, got %d", n)
+	}
+
+	value, ok = m.Snapshot().Get([]byte("050"))
+	if !ok || string(value) != "new" {
+		t.Fatalf("expected a new snapshot to see the overwritten value, got %s", value)
+	}
+}
+
+func TestLSMT_ReadDuringWrites(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 1000, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := lsmt.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 2)
+
+	// A writer overwrites the keys while readers scan and get them
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("%03d", i%100))
+			if err := lsmt.Put(key, key); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			keys, values, err := lsmt.GreaterThanEqual([]byte("000"))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if len(keys) != 100 {
+				errs <- fmt.Errorf("expected 100 keys, got %d", len(keys))
+				return
+			}
+
+			for j := range keys {
+				if string(keys[j]) != string(values[j]) {
+					errs <- fmt.Errorf("expected %s to have its own value, got %s", keys[j], values[j])
+					return
+				}
+			}
+
+			value, err := lsmt.Get([]byte("042"))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if string(value) != "042" {
+				errs <- fmt.Errorf("expected 042, got %s", value)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// sortedSliceMemtable is a memtable keeping a map for lookups and a sorted slice of keys for iteration.
+type sortedSliceMemtable struct {
+	comparator Comparator
+	values     map[string][]byte
+	keys       [][]byte
+	mem        int64
+}
+
+type sortedSliceIterator struct {
+	m   *sortedSliceMemtable
+	pos int
+}
+
+func newSortedSliceMemtable(comparator Comparator) Memtable {
+	return &sortedSliceMemtable{comparator: comparator, values: make(map[string][]byte)}
+}
+
+func (m *sortedSliceMemtable) search(key []byte) int {
+	i, _ := slices.BinarySearchFunc(m.keys, key, m.comparator.Compare)
+	return i
+}
+
+func (m *sortedSliceMemtable) Insert(key, value []byte) ([]byte, bool) {
+	old, ok := m.values[string(key)]
+	m.values[string(key)] = value
+	m.mem += int64(len(value) - len(old))
+
+	if !ok {
+		m.keys = slices.Insert(m.keys, m.search(key), key)
+		m.mem += int64(len(key))
+	}
+
+	return old, ok
+}
+
+func (m *sortedSliceMemtable) Get(key []byte) ([]byte, bool) {
+	value, ok := m.values[string(key)]
+	return value, ok
+}
+
+func (m *sortedSliceMemtable) Delete(key []byte) ([]byte, bool) {
+	old, ok := m.values[string(key)]
+	if ok {
+		delete(m.values, string(key))
+		m.keys = slices.Delete(m.keys, m.search(key), m.search(key)+1)
+		m.mem -= int64(len(key) + len(old))
+	}
+
+	return old, ok
+}
+
+func (m *sortedSliceMemtable) Seek(key []byte) MemtableIterator {
+	if key == nil {
+		return &sortedSliceIterator{m: m}
+	}
+
+	return &sortedSliceIterator{m: m, pos: m.search(key)}
+}
+
+func (m *sortedSliceMemtable) ApproximateSize() int64 {
+	return m.mem
+}
+
+func (m *sortedSliceMemtable) Len() int {
+	return len(m.keys)
+}
+
+func (m *sortedSliceMemtable) Concurrent() bool {
+	return false
+}
+
+func (it *sortedSliceIterator) Valid() bool {
+	return it.pos < len(it.m.keys)
+}
+
+func (it *sortedSliceIterator) Key() []byte {
+	return it.m.keys[it.pos]
+}
+
+func (it *sortedSliceIterator) Value() []byte {
+	return it.m.values[string(it.m.keys[it.pos])]
+}
+
+func (it *sortedSliceIterator) Next() {
+	it.pos++
+}
+
+func TestLSMT_CustomMemtable(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 50, 4, 2, WithMemtable(newSortedSliceMemtable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 500; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = lsmt.DeleteRange([]byte("100"), []byte("199"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, values, err := lsmt.Range([]byte("095"), []byte("205"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 11 || string(keys[4]) != "099" || string(keys[5]) != "200" || string(values[5]) != "value200" {
+		t.Fatalf("expected 095 to 099 and 200 to 205, got %q", keys)
+	}
+}
+
+func TestLSMT_SkipListMemtable(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 100, 4, 2, WithMemtable(NewSkipListMemtable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 8)
+
+	// Many writers put at once, flushing and compacting along the way
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				key := []byte(fmt.Sprintf("%d-%03d", w, i))
+				if err := lsmt.Put(key, key); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	err = lsmt.Delete([]byte("3-100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.DeleteRange([]byte("5-000"), []byte("5-999"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		keys, _, err := lsmt.GreaterThanEqual([]byte("0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 8*250-251 {
+			t.Fatalf("expected %d keys, got %d", 8*250-251, len(keys))
+		}
+
+		value, err := lsmt.Get([]byte("7-249"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "7-249" {
+			t.Fatalf("expected 7-249, got %s", value)
+		}
+	}
+
+	check()
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = New("test_lsm_tree", 0755, 100, 4, 2, WithMemtable(NewSkipListMemtable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	check()
+}
+
+func TestLSMT_SkipListMemtableReplayOrder(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 100_000, 4, 2, WithMemtable(NewSkipListMemtable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 8)
+
+	// Writers race to put the same keys
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprintf("key-%d", i%10))
+				if err := lsmt.Put(key, []byte(fmt.Sprintf("%d-%d", w, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		value, err := lsmt.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen[key] = string(value)
+	}
+
+	// Crash, losing the memtable, and recover it from the write-ahead log
+	err = lsmt.wal.pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = New("test_lsm_tree", 0755, 100_000, 4, 2, WithMemtable(NewSkipListMemtable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	operations, err := lsmt.GetWal().Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lsmt.RunRecoveredOperations(operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range seen {
+		value, err := lsmt.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != expected {
+			t.Fatalf("expected %s for %s after replay, got %s", expected, key, value)
+		}
+	}
+}
+
+func TestLSMT_SkipListMemtableKeyLocks(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+	lsmt, err := New("test_lsm_tree", 0755, 100_000, 4, 2, WithMemtable(NewSkipListMemtable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	held := []byte("held")
+	stripe := func(key []byte) uint64 {
+		return maphash.Bytes(lsmt.keyLockSeed, key) % KEY_LOCK_STRIPES
+	}
+
+	other := []byte("other")
+	for i := 0; stripe(other) == stripe(held); i++ {
+		other = []byte(fmt.Sprintf("other%d", i))
+	}
+
+	unlock := lsmt.lockKey(held)
+
+	// A writer of another key does not wait for the writer of the held key
+	err = lsmt.Put(other, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer of the same key waits for it
+	done := make(chan error, 1)
+	go func() {
+		done <- lsmt.Put(held, held)
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("expected the writer of the held key to wait, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := lsmt.Get(held)
+	if err != nil || string(value) != "held" {
+		t.Fatalf("expected held, got %s (%v)", value, err)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !unix
+
+// Package lsmt
+// Memory maps for systems without mmap
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap is not supported, memory-mapped pagers can't be opened
+func mmap(file *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory-mapped pagers are not supported on this platform")
+}
+
+// munmap does nothing as nothing can be mapped
+func munmap(data []byte) error {
+	return nil
+}
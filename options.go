@@ -0,0 +1,318 @@
+// Package lsmt
+// Options for creating and opening an LSM-tree
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// CompactionStrategy decides when the LSM-tree compacts its SSTables.
+type CompactionStrategy int
+
+const (
+	CompactionFull   CompactionStrategy = iota // Merge all SSTables once there are more than CompactionInterval of them.
+	CompactionManual                           // Never compact automatically, Compact has to be called.
+)
+
+// SyncMode decides when writes to the write-ahead log are synced to disk.
+type SyncMode int
+
+const (
+	SyncNone   SyncMode = iota // Leave syncing to the operating system, a machine crash can lose the latest writes.
+	SyncAlways                 // Sync the write-ahead log after every write.
+)
+
+// Default values of the options.
+const (
+	DefaultDirectoryPerm      = os.FileMode(0755) // Permissions of a newly created directory.
+	DefaultMemtableFlushSize  = 0                 // Entries above which the memtable is flushed, 0 being no limit.
+	DefaultMemtableFlushBytes = 4 << 20           // Bytes of memory at which the memtable is flushed.
+	DefaultCompactionInterval = 8                 // SSTables above which a full compaction runs.
+	DefaultMinimumSSTables    = 2                 // SSTables a compaction splits its output into.
+	DefaultPageSize           = 1024              // Page size of SSTables, which store an entry per page.
+	DefaultPageCacheSize      = 8 << 20           // Bytes of SSTable pages cached in memory.
+)
+
+// ErrReadOnly is returned by writes to an LSM-tree opened read-only.
+var ErrReadOnly = errors.New("lsm-tree is read-only")
+
+// Options configures an LSM-tree.  DefaultOptions returns the options used when none are given.
+type Options struct {
+	DirectoryPerm      os.FileMode        // Permissions of the directory when it is created.
+	MemtableFlushSize  int                // Entries above which the memtable is flushed to an SSTable, 0 being no limit.
+	MemtableFlushBytes int64              // Bytes of memory, keys, values and nodes, at which the memtable is flushed to an SSTable, 0 being no limit.
+	MemoryBudget       *MemoryBudget      // Memory budget shared with other LSM-trees, nil if there is none.
+	CompactionStrategy CompactionStrategy // When SSTables are compacted.
+	CompactionInterval int                // SSTables above which CompactionFull compacts.
+	MinimumSSTables    int                // SSTables a compaction splits its output into.
+	SyncMode           SyncMode           // When the write-ahead log is synced to disk.
+	PageSize           int                // Page size of new SSTables, header included.  Every entry takes at least a page, larger entries overflow into more.
+	PageCacheSize      int64              // Bytes of the page cache shared by the SSTables, 0 disabling it.
+	PageCache          *PageCache         // Page cache shared with other LSM-trees, used instead of one of PageCacheSize when set.
+	Comparator         Comparator         // The ordering of the keys, it cannot change once the LSM-tree is created.
+	Memtable           MemtableFactory    // Creates the memtables, NewAVLMemtable or NewSkipListMemtable.
+	MergeOperator      MergeOperator      // Folds merge operands, nil if merges are not used.
+	CompactionFilter   CompactionFilter   // Invoked for every key-value pair compaction writes, nil if not used.
+	DefaultTTL         time.Duration      // Time to live given to keys put without one, 0 meaning keys never expire.
+	Logger             *log.Logger        // Receives flush and compaction events, nil discards them.
+	ReadOnly           bool               // Open an existing LSM-tree without the write-ahead log, rejecting writes.
+	Mmap               bool               // Read SSTables through memory maps instead of the page cache.
+	TruncateWal        bool               // Drop the operations of the write-ahead log once they are flushed to an SSTable.
+}
+
+// Option modifies the options of an LSM-tree.
+type Option func(*Options)
+
+// DefaultOptions returns the default options of an LSM-tree.
+func DefaultOptions() Options {
+	return Options{
+		DirectoryPerm:      DefaultDirectoryPerm,
+		MemtableFlushSize:  DefaultMemtableFlushSize,
+		MemtableFlushBytes: DefaultMemtableFlushBytes,
+		CompactionStrategy: CompactionFull,
+		CompactionInterval: DefaultCompactionInterval,
+		MinimumSSTables:    DefaultMinimumSSTables,
+		PageSize:           DefaultPageSize,
+		PageCacheSize:      DefaultPageCacheSize,
+		SyncMode:           SyncNone,
+		Comparator:         BytewiseComparator,
+		Memtable:           NewAVLMemtable,
+	}
+}
+
+// validate checks the options are usable.
+func (o *Options) validate() error {
+	if o.MemtableFlushSize < 0 {
+		return errors.New("memtable flush size cannot be negative")
+	}
+
+	if o.MemtableFlushBytes < 0 {
+		return errors.New("memtable flush bytes cannot be negative")
+	}
+
+	if o.MemtableFlushSize == 0 && o.MemtableFlushBytes == 0 && o.MemoryBudget == nil {
+		return errors.New("memtable flush size, memtable flush bytes or a memory budget must be set")
+	}
+
+	if o.MemoryBudget != nil && o.MemoryBudget.limit <= 0 {
+		return errors.New("memory budget limit must be greater than zero")
+	}
+
+	switch o.CompactionStrategy {
+	case CompactionFull:
+		if o.CompactionInterval < 1 {
+			return errors.New("compaction interval must be at least 1")
+		}
+	case CompactionManual:
+	default:
+		return errors.New("unknown compaction strategy")
+	}
+
+	if o.MinimumSSTables < 1 {
+		return errors.New("minimum sstables must be at least 1")
+	}
+
+	if o.SyncMode != SyncNone && o.SyncMode != SyncAlways {
+		return errors.New("unknown sync mode")
+	}
+
+	if err := validatePageSize(int64(o.PageSize)); err != nil {
+		return err
+	}
+
+	if o.PageCacheSize < 0 {
+		return errors.New("page cache size cannot be negative")
+	}
+
+	if o.Comparator == nil {
+		return errors.New("comparator cannot be nil")
+	}
+
+	if o.Memtable == nil {
+		return errors.New("memtable factory cannot be nil")
+	}
+
+	if o.DefaultTTL < 0 {
+		return errors.New("default ttl cannot be negative")
+	}
+
+	return nil
+}
+
+// logger returns the logger of the options, discarding everything if none is set.
+func (o *Options) logger() *log.Logger {
+	if o.Logger == nil {
+		return log.New(io.Discard, "", 0)
+	}
+
+	return o.Logger
+}
+
+// WithOptions replaces all options with the provided ones.
+func WithOptions(options Options) Option {
+	return func(o *Options) {
+		*o = options
+	}
+}
+
+// WithDirectoryPerm sets the permissions of the directory when it is created.
+func WithDirectoryPerm(perm os.FileMode) Option {
+	return func(o *Options) {
+		o.DirectoryPerm = perm
+	}
+}
+
+// WithMemtableFlushSize flushes the memtable once it holds more than size entries, 0 being no limit.
+func WithMemtableFlushSize(size int) Option {
+	return func(o *Options) {
+		o.MemtableFlushSize = size
+	}
+}
+
+// WithMemtableFlushBytes flushes the memtable once its keys, values and nodes take bytes of memory, 0 being no limit.
+func WithMemtableFlushBytes(bytes int64) Option {
+	return func(o *Options) {
+		o.MemtableFlushBytes = bytes
+	}
+}
+
+// WithMemoryBudget shares the memory budget between the memtables of every LSM-tree opened with it.
+func WithMemoryBudget(budget *MemoryBudget) Option {
+	return func(o *Options) {
+		o.MemoryBudget = budget
+	}
+}
+
+// WithCompactionStrategy sets when SSTables are compacted.
+func WithCompactionStrategy(strategy CompactionStrategy) Option {
+	return func(o *Options) {
+		o.CompactionStrategy = strategy
+	}
+}
+
+// WithCompactionInterval compacts once there are more than interval SSTables.
+func WithCompactionInterval(interval int) Option {
+	return func(o *Options) {
+		o.CompactionInterval = interval
+	}
+}
+
+// WithMinimumSSTables sets the number of SSTables a compaction splits its output into.
+func WithMinimumSSTables(n int) Option {
+	return func(o *Options) {
+		o.MinimumSSTables = n
+	}
+}
+
+// WithSyncMode sets when the write-ahead log is synced to disk.
+func WithSyncMode(mode SyncMode) Option {
+	return func(o *Options) {
+		o.SyncMode = mode
+	}
+}
+
+// WithPageSize sets the page size of new SSTables, between MIN_PAGE_SIZE and MAX_PAGE_SIZE.
+// Existing SSTables keep the page size they were written with.
+func WithPageSize(size int) Option {
+	return func(o *Options) {
+		o.PageSize = size
+	}
+}
+
+// WithPageCacheSize sets the bytes of the page cache shared by the SSTables of the LSM-tree, 0 disables it.
+func WithPageCacheSize(size int64) Option {
+	return func(o *Options) {
+		o.PageCacheSize = size
+	}
+}
+
+// WithPageCache shares the page cache between the SSTables of every LSM-tree opened with it.
+func WithPageCache(cache *PageCache) Option {
+	return func(o *Options) {
+		o.PageCache = cache
+	}
+}
+
+// WithComparator orders the keys of the LSM-tree with the comparator instead of BytewiseComparator.
+// An LSM-tree must always be opened with the comparator it was created with.
+func WithComparator(comparator Comparator) Option {
+	return func(o *Options) {
+		o.Comparator = comparator
+	}
+}
+
+// WithMemtable creates the memtables of the LSM-tree with the factory, NewSkipListMemtable lets many goroutines write at once.
+func WithMemtable(factory MemtableFactory) Option {
+	return func(o *Options) {
+		o.Memtable = factory
+	}
+}
+
+// WithMergeOperator registers the merge operator used by Merge.
+func WithMergeOperator(mergeOperator MergeOperator) Option {
+	return func(o *Options) {
+		o.MergeOperator = mergeOperator
+	}
+}
+
+// WithCompactionFilter registers a compaction filter which can drop or rewrite key-value pairs on compaction.
+func WithCompactionFilter(compactionFilter CompactionFilter) Option {
+	return func(o *Options) {
+		o.CompactionFilter = compactionFilter
+	}
+}
+
+// WithDefaultTTL gives every key put without a time to live the provided one.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.DefaultTTL = ttl
+	}
+}
+
+// WithLogger sends flush and compaction events to the logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithReadOnly opens an existing LSM-tree read-only, writes return ErrReadOnly.
+func WithReadOnly() Option {
+	return func(o *Options) {
+		o.ReadOnly = true
+	}
+}
+
+// WithWalTruncation empties the write-ahead log every time the memtable is flushed, giving its space back.
+// Recovering the log then only replays the operations which are not in an SSTable yet.
+func WithWalTruncation() Option {
+	return func(o *Options) {
+		o.TruncateWal = true
+	}
+}
+
+// WithMmap reads SSTables through memory maps, without syscalls or copies.
+// SSTables are memory-mapped once written, a compacted SSTable is unmapped once its readers are done.
+func WithMmap() Option {
+	return func(o *Options) {
+		o.Mmap = true
+	}
+}
@@ -0,0 +1,317 @@
+// Package lsmt tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"negative flush size", WithMemtableFlushSize(-1)},
+		{"negative flush bytes", WithMemtableFlushBytes(-1)},
+		{"no flush threshold", WithOptions(Options{MinimumSSTables: 1, CompactionInterval: 1, Comparator: BytewiseComparator})},
+		{"zero compaction interval", WithCompactionInterval(0)},
+		{"unknown compaction strategy", WithCompactionStrategy(CompactionStrategy(7))},
+		{"zero minimum sstables", WithMinimumSSTables(0)},
+		{"unknown sync mode", WithSyncMode(SyncMode(7))},
+		{"nil comparator", WithComparator(nil)},
+		{"negative ttl", WithDefaultTTL(-1)},
+		{"zero memory budget", WithMemoryBudget(NewMemoryBudget(0))},
+		{"page size too small", WithPageSize(MIN_PAGE_SIZE - 1)},
+		{"page size too large", WithPageSize(MAX_PAGE_SIZE + 1)},
+	}
+
+	for _, test := range tests {
+		options := DefaultOptions()
+		test.opt(&options)
+
+		if err := options.validate(); err == nil {
+			t.Fatalf("expected %s to be invalid", test.name)
+		}
+	}
+
+	options := DefaultOptions()
+	if err := options.validate(); err != nil {
+		t.Fatalf("expected default options to be valid, got %v", err)
+	}
+
+	// A manual compaction strategy does not need an interval
+	options.CompactionStrategy = CompactionManual
+	options.CompactionInterval = 0
+	if err := options.validate(); err != nil {
+		t.Fatalf("expected manual compaction without an interval to be valid, got %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	var logs bytes.Buffer
+
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(10), WithSyncMode(SyncAlways), WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 25; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logs.String(), "flushed memtable") {
+		t.Fatalf("expected flushes to be logged, got %q", logs.String())
+	}
+
+	lsmt, err = Open("test_lsm_tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 25; i++ {
+		value, err := lsmt.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("expected value%d, got %s", i, value)
+		}
+	}
+}
+
+func TestOpen_InvalidOptions(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	_, err := Open("test_lsm_tree", WithMinimumSSTables(0))
+	if err == nil {
+		t.Fatal("expected an error opening with invalid options")
+	}
+
+	if _, err := os.Stat("test_lsm_tree"); !os.IsNotExist(err) {
+		t.Fatal("expected the directory not to be created")
+	}
+}
+
+func TestOpen_MemtableFlushBytes(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(0), WithMemtableFlushBytes(1024), WithCompactionStrategy(CompactionManual))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	value := bytes.Repeat([]byte("v"), 256)
+
+	for i := 0; i < 10; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("key%d", i)), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lsmt.memtableBytes.Load() >= 1024 {
+			t.Fatalf("expected the memtable to be flushed at 1024 bytes, it takes %d", lsmt.memtableBytes.Load())
+		}
+	}
+
+	// Every put takes more than 256 bytes, the memtable cannot hold 4 of them
+	if len(lsmt.sstables) < 3 {
+		t.Fatalf("expected at least 3 sstables, got %d", len(lsmt.sstables))
+	}
+}
+
+func TestNew_MemtableFlushBytes(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	lsmt, err := New("test_lsm_tree", 0755, 10, 100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lsmt.memtableFlushBytes != 0 {
+		t.Fatalf("expected no byte threshold, got %d", lsmt.memtableFlushBytes)
+	}
+
+	lsmt.Close()
+
+	lsmt, err = New("test_lsm_tree", 0755, 10, 100, 4, WithMemtableFlushBytes(1024), WithMemtableFlushSize(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	if lsmt.memtableFlushBytes != 1024 {
+		t.Fatalf("expected a byte threshold of 1024, got %d", lsmt.memtableFlushBytes)
+	}
+
+	if lsmt.memtableFlushSize != 20 {
+		t.Fatalf("expected the option to override the positional flush size, got %d", lsmt.memtableFlushSize)
+	}
+}
+
+func TestOpen_CompactionManual(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(10), WithCompactionStrategy(CompactionManual), WithCompactionInterval(1), WithMinimumSSTables(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	for i := 0; i < 100; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt.sstables) < 2 {
+		t.Fatalf("expected sstables not to be compacted, got %d", len(lsmt.sstables))
+	}
+
+	err = lsmt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lsmt.sstables) != 1 {
+		t.Fatalf("expected 1 sstable after compaction, got %d", len(lsmt.sstables))
+	}
+}
+
+func TestOpen_PageSize(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(10), WithPageSize(8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(lsmt.sstables) == 0 || lsmt.sstables[0].pager.PageSize() != 8192 {
+		t.Fatal("expected sstables with pages of 8192 bytes")
+	}
+
+	if lsmt.wal.pager.PageSize() != WAL_PAGE_SIZE {
+		t.Fatalf("expected the write-ahead log to have pages of %d bytes, got %d", WAL_PAGE_SIZE, lsmt.wal.pager.PageSize())
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing sstables keep their page size when opened with another
+	lsmt, err = Open("test_lsm_tree", WithMemtableFlushSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmt.Close()
+
+	if lsmt.sstables[0].pager.PageSize() != 8192 {
+		t.Fatalf("expected the sstable to keep pages of 8192 bytes, got %d", lsmt.sstables[0].pager.PageSize())
+	}
+
+	value, err := lsmt.Get([]byte("key5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "value5" {
+		t.Fatalf("expected value5, got %s", value)
+	}
+}
+
+func TestOpen_ReadOnly(t *testing.T) {
+	defer os.RemoveAll("test_lsm_tree")
+
+	_, err := Open("test_lsm_tree", WithReadOnly())
+	if err == nil {
+		t.Fatal("expected an error opening a missing lsm-tree read-only")
+	}
+
+	lsmt, err := Open("test_lsm_tree", WithMemtableFlushSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		err = lsmt.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = lsmt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmt, err = Open("test_lsm_tree", WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lsmt.Close()
+
+	value, err := lsmt.Get([]byte("key15"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "value15" {
+		t.Fatalf("expected value15, got %s", value)
+	}
+
+	if err := lsmt.Put([]byte("key"), []byte("value")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	if err := lsmt.Delete([]byte("key1")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	if err := lsmt.Compact(); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Package lsmt
+// Page header encoding
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+const PAGE_MAGIC = 0x4c50 // Magic number starting every page header
+
+// Page types
+const (
+	PAGE_TYPE_DATA     = 1 // First page of the data written to a page
+	PAGE_TYPE_OVERFLOW = 2 // Page continuing the data of the page linking to it
+	PAGE_TYPE_FREE     = 3 // Page on the free list, linking to the next free page
+)
+
+// ErrCorruptPage is matched by the errors returned when reading a corrupt page.
+var ErrCorruptPage = errors.New("corrupt page")
+
+// CorruptPageError is returned when a page header or its data fails validation.
+type CorruptPageError struct {
+	PageID int64  // The corrupt page.
+	Reason string // What failed to validate.
+}
+
+// Error returns the error message.
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("corrupt page %d: %s", e.PageID, e.Reason)
+}
+
+// Unwrap returns ErrCorruptPage so that errors.Is matches a CorruptPageError.
+func (e *CorruptPageError) Unwrap() error {
+	return ErrCorruptPage
+}
+
+// pageHeader is the header at the start of every page.
+// It is encoded in HEADER_SIZE bytes as magic (2), type (1), reserved (1), length (4), next page (8) and CRC32 (4), little endian.
+type pageHeader struct {
+	pageType byte   // The type of the page.
+	length   uint32 // The number of data bytes in the page.
+	next     int64  // The next page of the data, -1 for the last page.
+	checksum uint32 // The CRC32 of the header fields before it and of the data.
+}
+
+// crcTable is the CRC32 table page checksums are computed with.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// encodePage encodes a page from its type, next page and data, the data is padded to the page size.
+func encodePage(pageSize int64, pageType byte, next int64, data []byte) []byte {
+	page := make([]byte, pageSize)
+
+	binary.LittleEndian.PutUint16(page[0:], PAGE_MAGIC)
+	page[2] = pageType
+	binary.LittleEndian.PutUint32(page[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(page[8:], uint64(next))
+	copy(page[HEADER_SIZE:], data)
+
+	checksum := crc32.Update(crc32.Checksum(page[:16], crcTable), crcTable, data)
+	binary.LittleEndian.PutUint32(page[16:], checksum)
+
+	return page
+}
+
+// decodePageHeader decodes the header of a page, validating its magic number, type and length.
+func decodePageHeader(pageID int64, pageSize int64, data []byte) (pageHeader, error) {
+	if binary.LittleEndian.Uint16(data[0:]) != PAGE_MAGIC {
+		return pageHeader{}, &CorruptPageError{PageID: pageID, Reason: "bad magic number"}
+	}
+
+	header := pageHeader{
+		pageType: data[2],
+		length:   binary.LittleEndian.Uint32(data[4:]),
+		next:     int64(binary.LittleEndian.Uint64(data[8:])),
+		checksum: binary.LittleEndian.Uint32(data[16:]),
+	}
+
+	if header.pageType != PAGE_TYPE_DATA && header.pageType != PAGE_TYPE_OVERFLOW && header.pageType != PAGE_TYPE_FREE {
+		return pageHeader{}, &CorruptPageError{PageID: pageID, Reason: fmt.Sprintf("unknown page type %d", header.pageType)}
+	}
+
+	if int64(header.length) > pageSize-HEADER_SIZE {
+		return pageHeader{}, &CorruptPageError{PageID: pageID, Reason: fmt.Sprintf("data length %d is larger than the page", header.length)}
+	}
+
+	return header, nil
+}
+
+// decodePage decodes a page read from the file, returning its header and data once the checksum matches.
+func decodePage(pageID int64, page []byte) (pageHeader, []byte, error) {
+	header, err := decodePageHeader(pageID, int64(len(page)), page)
+	if err != nil {
+		return pageHeader{}, nil, err
+	}
+
+	data := page[HEADER_SIZE : HEADER_SIZE+header.length]
+
+	if crc32.Update(crc32.Checksum(page[:16], crcTable), crcTable, data) != header.checksum {
+		return pageHeader{}, nil, &CorruptPageError{PageID: pageID, Reason: "checksum mismatch"}
+	}
+
+	return header, data, nil
+}
+
+const SUPERBLOCK_MAGIC = "LSMTPAGE" // Magic string starting every paged file
+const SUPERBLOCK_VERSION = 2        // Version of the paged file format
+const SUPERBLOCK_SIZE = 36          // Bytes of the superblock, the rest of its page is reserved
+
+// ErrPageSizeMismatch is returned when a paged file is opened with a page size other than the one it was created with.
+var ErrPageSizeMismatch = errors.New("page size does not match the file")
+
+// ErrUnsupportedFormat is returned when a file was written in the format used before paged files had a superblock.
+// Such files have to be exported with the version of the package which wrote them, they are not migrated.
+var ErrUnsupportedFormat = errors.New("unsupported file format")
+
+const legacyHeaderSize = 256                   // Bytes of the page header of the legacy format, the next page in decimal
+const legacyPageSize = 1024 + legacyHeaderSize // Bytes of a page of the legacy format, header included
+const LEGACY_DELETED_PAGES_EXTENSION = ".del"  // Extension of the file the legacy format kept the deleted pages of a file in
+
+// superblock is the first page of a paged file, describing the file.
+// It is encoded as magic (8), version (4), page size (4), free list root (8), free pages (8) and CRC32 (4), little endian.
+type superblock struct {
+	pageSize     int64 // The size of the pages of the file, header included.
+	freeListRoot int64 // The first page of the free list, -1 if there are no free pages.
+	freePages    int64 // The number of pages on the free list.
+}
+
+// encodeSuperblock encodes the superblock in SUPERBLOCK_SIZE bytes.
+func encodeSuperblock(sb superblock) []byte {
+	data := make([]byte, SUPERBLOCK_SIZE)
+
+	copy(data, SUPERBLOCK_MAGIC)
+	binary.LittleEndian.PutUint32(data[8:], SUPERBLOCK_VERSION)
+	binary.LittleEndian.PutUint32(data[12:], uint32(sb.pageSize))
+	binary.LittleEndian.PutUint64(data[16:], uint64(sb.freeListRoot))
+	binary.LittleEndian.PutUint64(data[24:], uint64(sb.freePages))
+	binary.LittleEndian.PutUint32(data[32:], crc32.Checksum(data[:32], crcTable))
+
+	return data
+}
+
+// isLegacyFile returns whether a file of the given size starting with header was written in the legacy format.
+// A legacy page header holds the next page in decimal, -1 for the last page, padded with zero bytes.
+func isLegacyFile(size int64, header []byte) bool {
+	if size%legacyPageSize != 0 || len(header) < legacyHeaderSize {
+		return false
+	}
+
+	next := bytes.TrimRight(header[:legacyHeaderSize], "\x00")
+	if len(next) == 0 {
+		return false
+	}
+
+	_, err := strconv.ParseInt(string(next), 10, 64)
+	return err == nil
+}
+
+// decodeSuperblock decodes and validates the superblock at the start of a paged file.
+func decodeSuperblock(data []byte) (superblock, error) {
+	if string(data[:8]) != SUPERBLOCK_MAGIC {
+		return superblock{}, &CorruptPageError{PageID: -1, Reason: "bad superblock magic number"}
+	}
+
+	if crc32.Checksum(data[:32], crcTable) != binary.LittleEndian.Uint32(data[32:]) {
+		return superblock{}, &CorruptPageError{PageID: -1, Reason: "superblock checksum mismatch"}
+	}
+
+	if version := binary.LittleEndian.Uint32(data[8:]); version != SUPERBLOCK_VERSION {
+		return superblock{}, fmt.Errorf("unsupported paged file version %d", version)
+	}
+
+	sb := superblock{
+		pageSize:     int64(binary.LittleEndian.Uint32(data[12:])),
+		freeListRoot: int64(binary.LittleEndian.Uint64(data[16:])),
+		freePages:    int64(binary.LittleEndian.Uint64(data[24:])),
+	}
+
+	if err := validatePageSize(sb.pageSize); err != nil {
+		return superblock{}, &CorruptPageError{PageID: -1, Reason: err.Error()}
+	}
+
+	return sb, nil
+}
+
+// validatePageSize checks a page size is within MIN_PAGE_SIZE and MAX_PAGE_SIZE.
+func validatePageSize(pageSize int64) error {
+	if pageSize < MIN_PAGE_SIZE || pageSize > MAX_PAGE_SIZE {
+		return fmt.Errorf("page size %d is not between %d and %d", pageSize, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+	}
+
+	return nil
+}
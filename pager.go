@@ -17,137 +17,232 @@
 package lsmt
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"slices"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const PAGE_SIZE = 1024  // Page size
-const HEADER_SIZE = 256 // next (overflowed)
+const PAGE_SIZE = 4096      // Default page size, header included
+const MIN_PAGE_SIZE = 256   // Smallest page size
+const MAX_PAGE_SIZE = 65536 // Largest page size
+const HEADER_SIZE = 20      // magic, type, length, next (overflowed) and checksum, see page.go
+
+const PAGE_LOCK_STRIPES = 256 // Number of locks pages are spread over
+const RUN_PAGES = 64          // Most pages read or written at once by batched reads and writes
 
 // Pager manages pages in a file
 type Pager struct {
-	file             *os.File                // file to store pages
-	deletedPages     []int64                 // list of deleted pages
-	deletedPagesLock *sync.Mutex             // lock for deletedPages
-	deletedPagesFile *os.File                // file to store deleted pages
-	pageLocks        map[int64]*sync.RWMutex // locks for pages
-	pageLocksLock    *sync.RWMutex           // lock for pagesLocks
-	StatLock         *sync.RWMutex           // lock for stats
-	cachedCount      int64                   // cached count of pages
-	lastCacheTime    time.Time               // last time the cache was updated
-	interval         time.Duration           // interval to update the cache
+	file          *os.File       // file to store pages
+	vacuumLock    *sync.RWMutex  // shared by page operations, held exclusively by Vacuum while it moves pages
+	freeListLock  *sync.Mutex    // lock for the free list and page allocation
+	freeListRoot  int64          // first page of the free list, -1 if there are no free pages
+	freePages     int64          // number of pages on the free list
+	pages         atomic.Int64   // number of pages allocated in the file, changed under freeListLock and read without it
+	pageSize      int64          // size of the pages, header included
+	cache         *PageCache     // cache of the pages read, nil if there is none
+	mapping       []byte         // memory map of the file pages are read from, nil if the file is not mapped
+	writable      bool           // whether the file is opened for writing
+	cacheFile     uint64         // id of the file in the cache
+	pageLocks     []sync.RWMutex // locks for pages, a page is locked by the stripe its ID falls in
+	StatLock      *sync.RWMutex  // lock for stats
+	cachedCount   int64          // cached count of pages
+	lastCacheTime time.Time      // last time the cache was updated
+	interval      time.Duration  // interval to update the cache
 }
 
 // OpenPager opens a file for page management
-func OpenPager(filename string, flag int, perm os.FileMode) (*Pager, error) {
+// The page size is recorded in a superblock when the file is created, a page size of 0 opens an existing file with its own page size or creates one with PAGE_SIZE pages
+func OpenPager(filename string, flag int, perm os.FileMode, pageSize int) (*Pager, error) {
+	// the legacy format kept the deleted pages next to the file, they would be lost
+	_, err := os.Stat(filename + LEGACY_DELETED_PAGES_EXTENSION)
+	if err == nil {
+		return nil, fmt.Errorf("%w: %s holds the deleted pages of a file in the legacy format", ErrUnsupportedFormat, filename+LEGACY_DELETED_PAGES_EXTENSION)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	file, err := os.OpenFile(filename, flag, perm)
 	if err != nil {
 		return nil, err
 	}
 
-	// open the deleted pages file
-	deletedPagesFile, err := os.OpenFile(filename+".del", os.O_CREATE|os.O_RDWR, perm)
+	sb, err := openSuperblock(file, flag, int64(pageSize))
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	// read the deleted pages
-	deletedPages, err := readDelPages(deletedPagesFile)
+	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	pgLocks := make(map[int64]*sync.RWMutex)
+	p := &Pager{file: file, vacuumLock: &sync.RWMutex{}, freeListLock: &sync.Mutex{}, freeListRoot: sb.freeListRoot, freePages: sb.freePages, pageSize: sb.pageSize, writable: flag&(os.O_WRONLY|os.O_RDWR) != 0, pageLocks: make([]sync.RWMutex, PAGE_LOCK_STRIPES), StatLock: &sync.RWMutex{}, interval: time.Minute * 10, lastCacheTime: time.Now().Add(time.Minute * 10)}
+	p.pages.Store(pagesInFile(stat.Size(), sb.pageSize))
 
-	// Read the tree file and create locks for each page
-	stat, err := file.Stat()
+	return p, nil
+}
+
+// OpenMappedPager opens a file which is no longer written to for reading through a memory map
+// Pages are read from the map without syscalls, a page which does not overflow is returned as a slice of the map which is valid until the pager is closed
+func OpenMappedPager(filename string, pageSize int) (*Pager, error) {
+	p, err := OpenPager(filename, os.O_RDONLY, 0, pageSize)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := int64(0); i < stat.Size()/PAGE_SIZE; i++ {
-		pgLocks[i] = &sync.RWMutex{}
+	size := p.Size()
+	if size == 0 {
+		return p, nil
 	}
 
-	return &Pager{file: file, deletedPages: deletedPages, deletedPagesFile: deletedPagesFile, deletedPagesLock: &sync.Mutex{}, pageLocks: pgLocks, pageLocksLock: &sync.RWMutex{}, StatLock: &sync.RWMutex{}, interval: time.Minute * 10, lastCacheTime: time.Now().Add(time.Minute * 10)}, nil
+	p.mapping, err = mmap(p.file, int(size))
+	if err != nil {
+		p.file.Close()
+		return nil, err
+	}
+
+	return p, nil
 }
 
-// writeDelPages writes the deleted pages that are in-memory to the deleted pages file
-func (p *Pager) writeDelPages() error {
+// readAt returns size bytes of the file at offset, from the memory map if the file is mapped
+func (p *Pager) readAt(size int64, offset int64) ([]byte, error) {
+	if p.mapping != nil {
+		if offset+size > int64(len(p.mapping)) {
+			return nil, io.EOF
+		}
 
-	if p == nil {
-		return nil
+		return p.mapping[offset : offset+size : offset+size], nil
+	}
 
+	data := make([]byte, size)
+
+	_, err := p.file.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
 	}
 
-	// Truncate the file
-	err := p.deletedPagesFile.Truncate(0)
+	return data, nil
+}
+
+// openSuperblock writes the superblock of a new file, or reads and validates the superblock of an existing one
+func openSuperblock(file *os.File, flag int, pageSize int64) (superblock, error) {
+	stat, err := file.Stat()
 	if err != nil {
-		return err
+		return superblock{}, err
+	}
+
+	if stat.Size() == 0 {
+		if pageSize == 0 {
+			pageSize = PAGE_SIZE
+		}
+
+		err = validatePageSize(pageSize)
+		if err != nil {
+			return superblock{}, err
+		}
+
+		sb := superblock{pageSize: pageSize, freeListRoot: -1}
+
+		// a file opened read-only is left empty
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			// the superblock takes a whole page so that pages are aligned
+			page := make([]byte, pageSize)
+			copy(page, encodeSuperblock(sb))
+
+			_, err = file.WriteAt(page, 0)
+			if err != nil {
+				return superblock{}, err
+			}
+		}
+
+		return sb, nil
 	}
 
-	// Seek to the start of the file
-	_, err = p.deletedPagesFile.Seek(0, io.SeekStart)
+	data := make([]byte, max(SUPERBLOCK_SIZE, min(stat.Size(), legacyHeaderSize)))
+
+	_, err = file.ReadAt(data, 0)
 	if err != nil {
-		return err
+		return superblock{}, err
 	}
 
-	// Write the deleted pages to the file
-	_, err = p.deletedPagesFile.WriteAt([]byte(strings.Join(strings.Fields(fmt.Sprint(p.deletedPages)), ",")), 0)
+	// a file of the legacy format has no superblock, it is reported as such rather than as corrupt
+	if string(data[:len(SUPERBLOCK_MAGIC)]) != SUPERBLOCK_MAGIC && isLegacyFile(stat.Size(), data) {
+		return superblock{}, fmt.Errorf("%w: %s was written in the legacy format, without a superblock", ErrUnsupportedFormat, file.Name())
+	}
+
+	sb, err := decodeSuperblock(data[:SUPERBLOCK_SIZE])
 	if err != nil {
-		return err
+		return superblock{}, err
 	}
 
-	return nil
+	if pageSize != 0 && pageSize != sb.pageSize {
+		return superblock{}, fmt.Errorf("%w: opened with %d, created with %d", ErrPageSizeMismatch, pageSize, sb.pageSize)
+	}
+
+	return sb, nil
 }
 
-// readDelPages reads the deleted pages from the deleted pages file
-func readDelPages(file *os.File) ([]int64, error) {
-	pages := make([]int64, 0)
+// writeSuperblock writes the superblock with the current free list
+// the caller must hold freeListLock
+func (p *Pager) writeSuperblock() error {
+	_, err := p.file.WriteAt(encodeSuperblock(superblock{pageSize: p.pageSize, freeListRoot: p.freeListRoot, freePages: p.freePages}), 0)
+	return err
+}
 
-	// stored in comma separated format
-	// i.e. 1,2,3,4,5
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return nil, err
+// pagesInFile returns the number of pages in a file of the given size, the superblock excluded
+func pagesInFile(fileSize, pageSize int64) int64 {
+	if fileSize <= pageSize {
+		return 0
 	}
 
-	if len(data) == 0 {
-		return pages, nil
-	}
+	return (fileSize - 1) / pageSize
+}
 
-	data = bytes.TrimLeft(data, "[")
-	data = bytes.TrimRight(data, "]")
+// offset returns the position of a page in the file, pages start after the superblock
+func (p *Pager) offset(pageID int64) int64 {
+	return (pageID + 1) * p.pageSize
+}
 
-	// split the data into pages
-	pagesStr := strings.Split(string(data), ",")
+// PageSize returns the size of the pages, header included
+func (p *Pager) PageSize() int {
+	return int(p.pageSize)
+}
 
-	for _, pageStr := range pagesStr {
-		// convert the string to int64
-		page, err := strconv.ParseInt(pageStr, 10, 64)
-		if err != nil {
-			continue
-		}
+// SetPageCache caches the pages read by the pager in the page cache, which can be shared with other pagers
+// It must be called before the pager is used concurrently
+func (p *Pager) SetPageCache(cache *PageCache) {
+	p.cache = cache
+	p.cacheFile = pageCacheFiles.Add(1)
+}
 
-		pages = append(pages, page)
+// cacheKey returns the key of a page in the page cache
+func (p *Pager) cacheKey(pageID int64) pageCacheKey {
+	return pageCacheKey{file: p.cacheFile, pageID: pageID}
+}
 
+// invalidate removes rewritten or freed pages from the page cache
+func (p *Pager) invalidate(pageIDs ...int64) {
+	if p.cache == nil {
+		return
 	}
 
-	return pages, nil
+	for _, pageID := range pageIDs {
+		p.cache.invalidate(p.cacheKey(pageID))
+	}
 }
 
-// splitDataIntoChunks splits data into chunks of PAGE_SIZE
-func splitDataIntoChunks(data []byte) [][]byte {
+// splitDataIntoChunks splits data into chunks of chunkSize
+func splitDataIntoChunks(data []byte, chunkSize int) [][]byte {
 	var chunks [][]byte
-	for i := 0; i < len(data); i += PAGE_SIZE {
-		end := i + PAGE_SIZE
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
 
 		// Check if end is beyond the length of data
 		if end > len(data) {
@@ -160,291 +255,722 @@ func splitDataIntoChunks(data []byte) [][]byte {
 }
 
 // WriteTo writes data to a specific page
+// Data larger than a page overflows into pages taken from the free list or the end of the file, the overflow pages the page had before are freed
 func (p *Pager) WriteTo(pageID int64, data []byte) error {
+	if pageID < 0 {
+		return fmt.Errorf("page %d is out of range", pageID)
+	}
+
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
+
+	return p.writeTo(pageID, data, false)
+}
+
+// writeTo writes data to a page, a fresh page was just allocated and has nothing to free
+// the caller must hold vacuumLock
+func (p *Pager) writeTo(pageID int64, data []byte, fresh bool) error {
 	// lock the page
 	p.getPageLock(pageID).Lock()
 	defer p.getPageLock(pageID).Unlock()
 
-	p.DeletePage(pageID)
-	// remove from deleted pages
-	p.deletedPagesLock.Lock()
-	defer p.deletedPagesLock.Unlock()
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	root, freePages := p.freeListRoot, p.freePages
+
+	// the overflow pages linked to the page are not needed anymore as we are rewriting it
+	var oldOverflowPages []int64
+
+	if !fresh && pageID < p.pages.Load() {
+		header, err := p.readHeader(pageID)
+		switch {
+		case err == io.EOF:
+			// the page is allocated but not written yet
+		case errors.Is(err, ErrCorruptPage):
+			// a corrupt page is overwritten all the same, its overflow pages can't be followed
+		case err != nil:
+			return err
+		case header.pageType == PAGE_TYPE_FREE:
+			err = p.unlinkFree(pageID, header.next)
+			if err != nil {
+				return err
+			}
+		case header.pageType == PAGE_TYPE_DATA:
+			oldOverflowPages, err = p.overflowPages(pageID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the pages between the end of the file and the page are freed rather than left as holes
+	var gapPages []int64
+	for gapPage := p.pages.Load(); gapPage < pageID; gapPage++ {
+		gapPages = append(gapPages, gapPage)
+	}
+
+	if pageID >= p.pages.Load() {
+		p.pages.Store(pageID + 1)
+	}
+
+	chunks := splitDataIntoChunks(data, int(p.pageSize-HEADER_SIZE))
+	if len(chunks) == 0 {
+		chunks = append(chunks, nil)
+	}
+
+	// allocate a page for each chunk after the first, index 0 would have the next page of index 1 and the last chunk a next page of -1
+	pageIDs := []int64{pageID}
+	for range chunks[1:] {
+		overflowPageID, err := p.allocate()
+		if err != nil {
+			return err
+		}
 
-	for i, page := range p.deletedPages {
-		if page == pageID {
-			p.deletedPages = append(p.deletedPages[:i], p.deletedPages[i+1:]...)
+		pageIDs = append(pageIDs, overflowPageID)
+	}
+
+	// the pages taken from the free list are durably removed from it before they are written
+	if p.freeListRoot != root || p.freePages != freePages {
+		err := p.writeSuperblock()
+		if err != nil {
+			return err
 		}
 
+		err = fdatasync(p.file)
+		if err != nil {
+			return err
+		}
 	}
 
-	// the reason we are doing this is because we are going to write to the page thus having any overflowed pages which are linked to the page may not be needed
+	// chunks going to consecutive pages are written with a write per RUN_PAGES pages, like WriteRun
+	buf := make([]byte, 0, min(int64(len(chunks)), RUN_PAGES)*p.pageSize)
+	start := 0
 
-	// check if data is larger than the page size
-	if len(data) > PAGE_SIZE {
-		// create an array [][]byte
-		// each element is a page
+	for i, chunk := range chunks {
+		nextPage := int64(-1)
+		if i < len(chunks)-1 {
+			nextPage = pageIDs[i+1]
+		}
 
-		chunks := splitDataIntoChunks(data)
+		pageType := byte(PAGE_TYPE_DATA)
+		if i > 0 {
+			pageType = PAGE_TYPE_OVERFLOW
+		}
 
-		// clear data to free up memory
-		data = nil
+		buf = append(buf, encodePage(p.pageSize, pageType, nextPage, chunk)...)
 
-		headerBuffer := make([]byte, HEADER_SIZE)
+		// the run ends at the last chunk, at a page which does not follow the previous one or when the buffer is full
+		if i == len(chunks)-1 || pageIDs[i+1] != pageIDs[i]+1 || len(buf) == cap(buf) {
+			_, err := p.file.WriteAt(buf, p.offset(pageIDs[start]))
+			if err != nil {
+				return err
+			}
 
-		// We need to create pages for each chunk
-		// after index 0
-		// the next page is the current page + 1
+			buf = buf[:0]
+			start = i + 1
+		}
+	}
 
-		// index 0 would have the next page of index 1 index 1 would have the next page of index 2
+	p.invalidate(pageID)
 
-		for i, chunk := range chunks {
-			// check if we are at the last chunk
-			if i == len(chunks)-1 {
-				headerBuffer = make([]byte, HEADER_SIZE)
-				nextPage := pageID + 1
-				copy(headerBuffer, strconv.FormatInt(nextPage, 10))
+	return p.free(append(gapPages, oldOverflowPages...))
+}
 
-				// if chunk is less than PAGE_SIZE, we need to pad it with null bytes
-				if len(chunk) < PAGE_SIZE {
-					chunk = append(chunk, make([]byte, PAGE_SIZE-len(chunk))...)
-				}
+// allocate returns a free page, pages on the free list are reused before growing the file
+// the caller must hold freeListLock and write the superblock before writing to the page
+func (p *Pager) allocate() (int64, error) {
+	if p.freeListRoot == -1 {
+		return p.pages.Add(1) - 1, nil
+	}
 
-				// write the chunk to the file
-				_, err := p.file.WriteAt(append(headerBuffer, chunk...), pageID*(PAGE_SIZE+HEADER_SIZE))
-				if err != nil {
-					return err
-				}
+	pageID := p.freeListRoot
 
-			} else {
-				// update the header
-				headerBuffer = make([]byte, HEADER_SIZE)
-				nextPage := pageID + 1
-				copy(headerBuffer, strconv.FormatInt(nextPage, 10))
+	header, err := p.readHeader(pageID)
+	if err != nil {
+		return -1, err
+	}
 
-				if len(chunk) < PAGE_SIZE {
-					chunk = append(chunk, make([]byte, PAGE_SIZE-len(chunk))...)
-				}
+	if header.pageType != PAGE_TYPE_FREE {
+		return -1, &CorruptPageError{PageID: pageID, Reason: "free list links to a page in use"}
+	}
 
-				// write the chunk to the file
-				_, err := p.file.WriteAt(append(headerBuffer, chunk...), pageID*(PAGE_SIZE+HEADER_SIZE))
-				if err != nil {
-					return err
-				}
+	p.freeListRoot = header.next
+	p.freePages--
 
-				// update the pageID
-				pageID = nextPage
+	return pageID, nil
+}
 
-			}
+// free pushes pages on the free list in O(1) per page, each freed page links to the next and the last one to the previous root
+// the pages are written before the superblock, a crash in between leaves them off the free list rather than the free list linking to pages in use
+// the caller must hold freeListLock
+func (p *Pager) free(pageIDs []int64) error {
+	if len(pageIDs) == 0 {
+		return nil
+	}
+
+	for i, pageID := range pageIDs {
+		nextPage := p.freeListRoot
+		if i < len(pageIDs)-1 {
+			nextPage = pageIDs[i+1]
 		}
 
-	} else {
-		// create a buffer to store the header
-		headerBuffer := make([]byte, HEADER_SIZE)
+		// a free page only has a header
+		_, err := p.file.WriteAt(encodePage(HEADER_SIZE, PAGE_TYPE_FREE, nextPage, nil), p.offset(pageID))
+		if err != nil {
+			return err
+		}
+	}
 
-		// set the next page to -1
-		copy(headerBuffer, "-1")
+	p.invalidate(pageIDs...)
 
-		// if data is less than PAGE_SIZE, we need to pad it with null bytes
-		if len(data) < PAGE_SIZE {
-			data = append(data, make([]byte, PAGE_SIZE-len(data))...)
-		}
+	// the free pages are durable before the superblock links to them
+	err := fdatasync(p.file)
+	if err != nil {
+		return err
+	}
+
+	p.freeListRoot = pageIDs[0]
+	p.freePages += int64(len(pageIDs))
+
+	return p.writeSuperblock()
+}
+
+// unlinkFree removes a page from the middle of the free list, which takes walking the list up to the page
+// the caller must hold freeListLock and write the superblock
+func (p *Pager) unlinkFree(pageID, nextPage int64) error {
+	if p.freeListRoot == pageID {
+		p.freeListRoot = nextPage
+		p.freePages--
+		return nil
+	}
 
-		// write the data to the file
-		_, err := p.file.WriteAt(append(headerBuffer, data...), (PAGE_SIZE+HEADER_SIZE)*pageID)
+	for prev, i := p.freeListRoot, int64(0); prev != -1 && i < p.freePages; i++ {
+		header, err := p.readHeader(prev)
 		if err != nil {
 			return err
 		}
 
+		if header.next == pageID {
+			// link the previous free page past the page
+			_, err = p.file.WriteAt(encodePage(HEADER_SIZE, PAGE_TYPE_FREE, nextPage, nil), p.offset(prev))
+			if err != nil {
+				return err
+			}
+
+			p.freePages--
+			return nil
+		}
+
+		prev = header.next
 	}
 
-	return nil
+	return &CorruptPageError{PageID: pageID, Reason: "free page is not on the free list"}
+}
+
+// readHeader reads the header of a page
+func (p *Pager) readHeader(pageID int64) (pageHeader, error) {
+	header, err := p.readAt(HEADER_SIZE, p.offset(pageID))
+	if err != nil {
+		return pageHeader{}, err
+	}
+
+	return decodePageHeader(pageID, p.pageSize, header)
+}
+
+// overflowPages returns the overflow pages linked to a page
+// overflow pages which follow each other are read ahead in runs of doubling length, like readPage
+// the caller must hold freeListLock
+func (p *Pager) overflowPages(pageID int64) ([]int64, error) {
+	var pages []int64
+
+	header, err := p.readHeader(pageID)
+	if err != nil {
+		return nil, err
+	}
+
+	count := p.pages.Load()
+	run := make(map[int64][]byte)
+	ahead := int64(1)
+
+	// a chain can't be longer than the file, this guards against chains which loop
+	for header.next != -1 && header.next < count && int64(len(pages)) < count {
+		prev := pageID
+		pageID = header.next
+		pages = append(pages, pageID)
+
+		page, ok := run[pageID]
+		if !ok {
+			pagesAhead := int64(1)
+			if pageID == prev+1 {
+				ahead = min(ahead*2, RUN_PAGES)
+				pagesAhead = max(min(ahead, count-pageID), 1)
+			} else {
+				ahead = 1
+			}
+
+			err = p.readRun(pageID, pagesAhead, run)
+			if err != nil {
+				return nil, err
+			}
+
+			page, ok = run[pageID]
+			if !ok {
+				return nil, io.EOF
+			}
+		}
+
+		header, err = decodePageHeader(pageID, p.pageSize, page[:HEADER_SIZE])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pages, nil
 }
 
 // getPageLock gets the lock for a page
+// pages share a fixed set of locks, so getting one takes no lock of its own and the locks don't grow with the file
 func (p *Pager) getPageLock(pageID int64) *sync.RWMutex {
-	// Lock the mutex that protects the PageLocks map
-	p.pageLocksLock.Lock()
-	defer p.pageLocksLock.Unlock()
-
-	// Used for page level locking
-	// This is decent for concurrent reads and writes
-	if lock, ok := p.pageLocks[pageID]; ok {
-		return lock
-	} else {
-		// Create a new lock
-		p.pageLocks[pageID] = &sync.RWMutex{}
-		return p.pageLocks[pageID]
-	}
+	return &p.pageLocks[uint64(pageID)%PAGE_LOCK_STRIPES]
 }
 
 // Write writes data to the next available page
 func (p *Pager) Write(data []byte) (int64, error) {
+	// the page is allocated and written without Vacuum taking it back in between
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
 
-	// check if there are any deleted pages
-	if len(p.deletedPages) > 0 {
-		// get the last deleted page
-		pageID := p.deletedPages[len(p.deletedPages)-1]
-		p.deletedPages = p.deletedPages[:len(p.deletedPages)-1]
+	p.freeListLock.Lock()
+	root := p.freeListRoot
 
-		err := p.WriteTo(pageID, data)
-		if err != nil {
-			return -1, err
+	pageID, err := p.allocate()
+
+	// the page is durably taken off the free list before it is written
+	if err == nil && p.freeListRoot != root {
+		err = p.writeSuperblock()
+		if err == nil {
+			err = fdatasync(p.file)
 		}
+	}
+	p.freeListLock.Unlock()
 
-		return pageID, nil
+	if err != nil {
+		return -1, err
+	}
 
-	} else {
-		// get the current file size
-		fileInfo, err := p.file.Stat()
-		if err != nil {
-			return -1, err
+	err = p.writeTo(pageID, data, true)
+	if err != nil {
+		return -1, err
+	}
+
+	return pageID, nil
+}
+
+// WriteRun writes each data to the next page of a run of consecutive pages appended to the file, returning the pages written
+// Data larger than a page overflows into the pages following it in the run, the run is written with a write per RUN_PAGES pages and does not take pages from the free list
+func (p *Pager) WriteRun(data [][]byte) ([]int64, error) {
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
+
+	chunks := make([][][]byte, len(data))
+	count := int64(0)
+
+	for i := range data {
+		chunks[i] = splitDataIntoChunks(data[i], int(p.pageSize-HEADER_SIZE))
+		if len(chunks[i]) == 0 {
+			chunks[i] = append(chunks[i], nil)
 		}
 
-		if fileInfo.Size() == 0 {
+		count += int64(len(chunks[i]))
+	}
 
-			err = p.WriteTo(0, data)
-			if err != nil {
-				return -1, err
+	p.freeListLock.Lock()
+	pageID := p.pages.Add(count) - count
+	p.freeListLock.Unlock()
+
+	pageIDs := make([]int64, len(data))
+	offset := p.offset(pageID)
+	buf := make([]byte, 0, min(count, RUN_PAGES)*p.pageSize)
+
+	for i := range chunks {
+		pageIDs[i] = pageID
+
+		for j, chunk := range chunks[i] {
+			nextPage := int64(-1)
+			if j < len(chunks[i])-1 {
+				nextPage = pageID + 1
 			}
 
-			return 0, nil
-		}
+			pageType := byte(PAGE_TYPE_DATA)
+			if j > 0 {
+				pageType = PAGE_TYPE_OVERFLOW
+			}
 
-		// create a new page
-		pageId := fileInfo.Size() / (PAGE_SIZE + HEADER_SIZE)
+			buf = append(buf, encodePage(p.pageSize, pageType, nextPage, chunk)...)
+			pageID++
 
-		err = p.WriteTo(pageId, data)
-		if err != nil {
-			return -1, err
-		}
+			if len(buf) == cap(buf) {
+				_, err := p.file.WriteAt(buf, offset)
+				if err != nil {
+					return nil, err
+				}
 
-		return pageId, nil
+				offset += int64(len(buf))
+				buf = buf[:0]
+			}
+		}
+	}
 
+	if len(buf) > 0 {
+		_, err := p.file.WriteAt(buf, offset)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	return pageIDs, nil
 }
 
-// Close closes the file
-func (p *Pager) Close() error {
-	p.writeDelPages()
+// Sync flushes the pages written and the free list to disk, with fdatasync semantics
+func (p *Pager) Sync() error {
+	return fdatasync(p.file)
+}
 
+// Close syncs and closes the file, returning every error met on the way
+func (p *Pager) Close() error {
 	if p != nil {
-		return p.file.Close()
+		if p.cache != nil {
+			p.cache.invalidateFile(p.cacheFile)
+		}
+
+		var errs []error
+
+		if p.mapping != nil {
+			errs = append(errs, munmap(p.mapping))
+			p.mapping = nil
+		}
+
+		// a read-only file has nothing to sync
+		if p.writable {
+			errs = append(errs, p.Sync())
+		}
+
+		errs = append(errs, p.file.Close())
+
+		return errors.Join(errs...)
 	}
 
 	return nil
 }
 
 // GetPage gets a page and returns the data
-// Will gather all the pages that are linked together
+// Will gather all the pages that are linked together, an overflow page is part of the page it is linked from and returns nil as does a free page
+// The data can be shared with the page cache and must not be modified
 func (p *Pager) GetPage(pageID int64) ([]byte, error) {
+	return p.getPage(pageID, false)
+}
 
-	// lock the page
-	p.getPageLock(pageID).Lock()
-	defer p.getPageLock(pageID).Unlock()
+// PinPage gets a page like GetPage, keeping it in the page cache until UnpinPage is called
+func (p *Pager) PinPage(pageID int64) ([]byte, error) {
+	return p.getPage(pageID, true)
+}
+
+// UnpinPage releases a page pinned with PinPage
+func (p *Pager) UnpinPage(pageID int64) {
+	if p.cache != nil {
+		p.cache.unpin(p.cacheKey(pageID))
+	}
+}
+
+// getPage gets a page through the page cache, pinning it if asked to
+func (p *Pager) getPage(pageID int64, pin bool) ([]byte, error) {
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
+
+	pages := p.pages.Load()
+
+	// readers share the page lock, a writer of the page waits for them
+	p.getPageLock(pageID).RLock()
+	defer p.getPageLock(pageID).RUnlock()
+
+	// a memory-mapped file is read without copies, caching its pages would only take memory
+	if p.mapping != nil {
+		return p.readPage(pageID, pages, nil)
+	}
 
-	p.deletedPagesLock.Lock()
-	// Check if in deleted pages, if so return nil
-	if slices.Contains(p.deletedPages, pageID) {
-		p.deletedPagesLock.Unlock()
-		return nil, nil
+	if p.cache != nil {
+		if data, ok := p.cache.get(p.cacheKey(pageID), pin); ok {
+			return data, nil
+		}
 	}
-	p.deletedPagesLock.Unlock()
 
+	data, err := p.readPage(pageID, pages, nil)
+	if err != nil || data == nil || p.cache == nil {
+		return data, err
+	}
+
+	p.cache.put(p.cacheKey(pageID), data, pin)
+
+	return data, nil
+}
+
+// readPage reads a page and its overflow pages from the file, returning nil if the page is not the first page of data
+// run holds pages already read, overflow pages which follow each other are read ahead in runs of doubling length
+func (p *Pager) readPage(pageID int64, pages int64, run map[int64][]byte) ([]byte, error) {
 	result := make([]byte, 0)
+	ahead := int64(1)
+
+	for i, prev := int64(0), int64(-1); pageID != -1; i, prev = i+1, pageID {
+		// a chain can't be longer than the file, this guards against chains which loop
+		if i > pages {
+			return nil, &CorruptPageError{PageID: pageID, Reason: "page chain is longer than the file"}
+		}
+
+		// get the page
+		page, ok := run[pageID]
+		if !ok {
+			count := int64(1)
+			if i > 0 && pageID == prev+1 {
+				ahead = min(ahead*2, RUN_PAGES)
+				count = max(min(ahead, pages-pageID), 1)
+			} else {
+				ahead = 1
+			}
 
-	// get the page
-	dataPHeader := make([]byte, PAGE_SIZE+HEADER_SIZE)
+			if run == nil {
+				run = make(map[int64][]byte)
+			}
+
+			err := p.readRun(pageID, count, run)
+			if err != nil {
+				return nil, err
+			}
 
-	if pageID == 0 {
+			page, ok = run[pageID]
+			if !ok {
+				return nil, io.EOF
+			}
+		}
 
-		_, err := p.file.ReadAt(dataPHeader, 0)
+		header, data, err := decodePage(pageID, page)
 		if err != nil {
 			return nil, err
 		}
+
+		if i == 0 && header.pageType != PAGE_TYPE_DATA {
+			return nil, nil
+		}
+
+		if i > 0 && header.pageType != PAGE_TYPE_OVERFLOW {
+			return nil, &CorruptPageError{PageID: pageID, Reason: "page chain links to a page which is not an overflow page"}
+		}
+
+		// the data of a page which does not overflow is not copied out of the memory map
+		if i == 0 && header.next == -1 && p.mapping != nil {
+			return data, nil
+		}
+
+		// append the data to the result
+		result = append(result, data...)
+
+		pageID = header.next
+	}
+
+	return result, nil
+}
+
+// readRun reads count pages from pageID with one read, adding the pages to run
+// the pages past the end of the file are left out
+func (p *Pager) readRun(pageID int64, count int64, run map[int64][]byte) error {
+	var data []byte
+
+	if p.mapping != nil {
+		offset := min(p.offset(pageID), int64(len(p.mapping)))
+		data = p.mapping[offset:min(offset+count*p.pageSize, int64(len(p.mapping)))]
 	} else {
+		data = make([]byte, count*p.pageSize)
 
-		_, err := p.file.ReadAt(dataPHeader, pageID*(PAGE_SIZE+HEADER_SIZE))
-		if err != nil {
-			return nil, err
+		n, err := p.file.ReadAt(data, p.offset(pageID))
+		if err != nil && err != io.EOF {
+			return err
 		}
+
+		data = data[:n]
 	}
 
-	// get header
-	header := dataPHeader[:HEADER_SIZE]
-	data := dataPHeader[HEADER_SIZE:]
+	for i := int64(0); (i+1)*p.pageSize <= int64(len(data)); i++ {
+		run[pageID+i] = data[i*p.pageSize : (i+1)*p.pageSize : (i+1)*p.pageSize]
+	}
+
+	return nil
+}
 
-	// remove the null bytes
-	header = bytes.Trim(header, "\x00")
-	//data = bytes.Trim(data, "\x00")
+// ReadPages gets pages like GetPage, reading each run of consecutive pages which are not cached with one read
+func (p *Pager) ReadPages(pageIDs []int64) ([][]byte, error) {
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
 
-	// append the data to the result
-	result = append(result, data...)
+	pages := p.pages.Load()
+	results := make([][]byte, len(pageIDs))
 
-	// get the next page
-	nextPage, err := strconv.ParseInt(string(header), 10, 64)
-	if err != nil {
-		return nil, err
+	// a memory-mapped file is read without copies and is not cached, see getPage
+	cache := p.cache
+	if p.mapping != nil {
+		cache = nil
 	}
 
-	if nextPage == -1 {
-		return result, nil
+	var missed []int
+	var missedIDs []int64
 
+	for i, pageID := range pageIDs {
+		if cache != nil {
+			// a miss is only recorded once the page is read and turns out to be the first page of data
+			if data, ok := cache.lookup(p.cacheKey(pageID), false); ok {
+				results[i] = data
+				continue
+			}
+		}
+
+		missed = append(missed, i)
+		missedIDs = append(missedIDs, pageID)
+	}
+
+	if len(missed) == 0 {
+		return results, nil
+	}
+
+	slices.Sort(missedIDs)
+	missedIDs = slices.Compact(missedIDs)
+
+	// the page locks are taken in order, so that readers taking several don't deadlock with writers
+	var stripes []uint64
+	for _, pageID := range missedIDs {
+		stripes = append(stripes, uint64(pageID)%PAGE_LOCK_STRIPES)
 	}
 
-	for {
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, stripe := range stripes {
+		p.pageLocks[stripe].RLock()
+		defer p.pageLocks[stripe].RUnlock()
+	}
 
-		dataPHeader = make([]byte, PAGE_SIZE+HEADER_SIZE)
+	run := make(map[int64][]byte)
+
+	for start := 0; start < len(missedIDs); {
+		end := start + 1
+		for end < len(missedIDs) && missedIDs[end] == missedIDs[end-1]+1 && end-start < RUN_PAGES {
+			end++
+		}
 
-		_, err := p.file.ReadAt(dataPHeader, nextPage*(PAGE_SIZE+HEADER_SIZE))
+		err := p.readRun(missedIDs[start], int64(end-start), run)
 		if err != nil {
-			break
+			return nil, err
 		}
 
-		// get header
-		header = dataPHeader[:HEADER_SIZE]
-		data = dataPHeader[HEADER_SIZE:]
+		start = end
+	}
 
-		// remove the null bytes
-		header = bytes.Trim(header, "\x00")
-		//data = bytes.Trim(data, "\x00")
+	for _, i := range missed {
+		data, err := p.readPage(pageIDs[i], pages, run)
+		if err != nil {
+			return nil, err
+		}
 
-		// append the data to the result
-		result = append(result, data...)
+		results[i] = data
 
-		// get the next page
-		nextPage, err = strconv.ParseInt(string(header), 10, 64)
-		if err != nil || nextPage == -1 {
-			break
+		if data != nil && cache != nil {
+			cache.missed(1)
+			cache.put(p.cacheKey(pageIDs[i]), data, false)
 		}
-
 	}
 
-	return result, nil
+	return results, nil
 }
 
-// GetDeletedPages returns the list of deleted pages
+// GetDeletedPages returns the list of deleted pages, walking the free list
 func (p *Pager) GetDeletedPages() []int64 {
-	p.deletedPagesLock.Lock()
-	defer p.deletedPagesLock.Unlock()
-	return p.deletedPages
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	pages := make([]int64, 0, p.freePages)
+
+	for pageID := p.freeListRoot; pageID != -1 && int64(len(pages)) < p.freePages; {
+		pages = append(pages, pageID)
+
+		header, err := p.readHeader(pageID)
+		if err != nil {
+			break
+		}
+
+		pageID = header.next
+	}
+
+	return pages
 }
 
-// DeletePage deletes a page
+// DeletePage deletes a page along with its overflow pages, putting them on the free list
 func (p *Pager) DeletePage(pageID int64) error {
-	p.deletedPagesLock.Lock()
-	defer p.deletedPagesLock.Unlock()
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
+
+	// lock the page
+	p.getPageLock(pageID).Lock()
+	defer p.getPageLock(pageID).Unlock()
+
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	// a page past the end of the file does not exist, it can't be put on the free list
+	if pageID < 0 || pageID >= p.pages.Load() {
+		return fmt.Errorf("page %d is out of range", pageID)
+	}
+
+	header, err := p.readHeader(pageID)
+	if err == io.EOF {
+		// the page is allocated but not written yet
+		return p.free([]int64{pageID})
+	} else if err != nil {
+		return err
+	}
 
-	// Add the page to the deleted pages
-	p.deletedPages = append(p.deletedPages, pageID)
+	switch header.pageType {
+	case PAGE_TYPE_FREE:
+		return nil
+	case PAGE_TYPE_OVERFLOW:
+		return fmt.Errorf("page %d is an overflow page, delete the page it continues", pageID)
+	}
 
-	// write the deleted pages to the file
-	err := p.writeDelPages()
+	overflowPages, err := p.overflowPages(pageID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return p.free(append([]int64{pageID}, overflowPages...))
+}
+
+// FreeFrom puts the pages from a page to the end of the file on the free list, pages already free are left as they are
+// The pages are not followed, which frees the corrupt pages a write torn by a crash left at the end of the file
+func (p *Pager) FreeFrom(pageID int64) error {
+	p.vacuumLock.RLock()
+	defer p.vacuumLock.RUnlock()
+
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	var pageIDs []int64
+	for ; pageID < p.pages.Load(); pageID++ {
+		header, err := p.readHeader(pageID)
+		if err == nil && header.pageType == PAGE_TYPE_FREE {
+			continue
+		}
+
+		pageIDs = append(pageIDs, pageID)
+	}
+
+	return p.free(pageIDs)
 }
 
 // Analyze forces the pager to analyze the file
@@ -459,12 +985,12 @@ func (p *Pager) Analyze() error {
 	stat, _ := p.file.Stat()
 	fileSize := stat.Size()
 
-	// Initialize a counter for the bytes read
-	var bytesRead int64 = 0
+	// Initialize a counter for the bytes read, skipping the superblock
+	var bytesRead int64 = p.pageSize
 
-	// Read through the file in chunks of PAGE_SIZE + HEADER_SIZE bytes
+	// Read through the file in chunks of the page size
 	for bytesRead < fileSize {
-		bytesRead += PAGE_SIZE + HEADER_SIZE
+		bytesRead += p.pageSize
 		pageCount++
 	}
 
@@ -483,9 +1009,32 @@ func (p *Pager) Size() int64 {
 	return stat.Size()
 }
 
+// PagerStats are the page counts of a pager
+type PagerStats struct {
+	Pages         int64   // pages in the file, the superblock excluded
+	LivePages     int64   // pages in use, overflow pages included
+	FreePages     int64   // pages on the free list
+	Fragmentation float64 // share of the pages of the file which are free
+}
+
+// Stats returns the page counts of the pager, without reading the file
+func (p *Pager) Stats() PagerStats {
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	pages := p.pages.Load()
+
+	stats := PagerStats{Pages: pages, LivePages: pages - p.freePages, FreePages: p.freePages}
+	if pages > 0 {
+		stats.Fragmentation = float64(p.freePages) / float64(pages)
+	}
+
+	return stats
+}
+
 // PagesCount  returns the number of pages
 func (p *Pager) PagesCount() int64 {
-	return p.Size() / (PAGE_SIZE + HEADER_SIZE)
+	return pagesInFile(p.Size(), p.pageSize)
 }
 
 // Count returns the number of pages
@@ -513,12 +1062,12 @@ func (p *Pager) Count() int64 {
 		stat, _ := p.file.Stat()
 		fileSize := stat.Size()
 
-		// Initialize a counter for the bytes read
-		var bytesRead int64 = 0
+		// Initialize a counter for the bytes read, skipping the superblock
+		var bytesRead int64 = p.pageSize
 
-		// Read through the file in chunks of PAGE_SIZE + HEADER_SIZE bytes
+		// Read through the file in chunks of the page size
 		for bytesRead < fileSize {
-			bytesRead += PAGE_SIZE + HEADER_SIZE
+			bytesRead += p.pageSize
 			pageCount++
 		}
 
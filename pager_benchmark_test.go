@@ -0,0 +1,135 @@
+// Package lsmt benchmarker
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkPager opens a pager with 1000 small pages
+func benchmarkPager(b *testing.B) *Pager {
+	pager, err := OpenPager("pager_benchmark.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		_, err = pager.Write([]byte(fmt.Sprintf("page %d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return pager
+}
+
+func BenchmarkPagerGetPage(b *testing.B) {
+	pager := benchmarkPager(b)
+	defer os.Remove("pager_benchmark.db")
+	defer pager.Close()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pager.GetPage(int64(i % 1000))
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see reads scale with the readers
+func BenchmarkPagerGetPageParallel(b *testing.B) {
+	pager := benchmarkPager(b)
+	defer os.Remove("pager_benchmark.db")
+	defer pager.Close()
+
+	b.ResetTimer()
+
+	i := atomic.Int64{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pager.GetPage(i.Add(1) % 1000)
+		}
+	})
+}
+
+// Readers of the same page don't wait for each other
+func BenchmarkPagerGetPageParallelSamePage(b *testing.B) {
+	pager := benchmarkPager(b)
+	defer os.Remove("pager_benchmark.db")
+	defer pager.Close()
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pager.GetPage(0)
+		}
+	})
+}
+
+func BenchmarkPagerGetPageParallelCache(b *testing.B) {
+	pager := benchmarkPager(b)
+	defer os.Remove("pager_benchmark.db")
+	defer pager.Close()
+
+	pager.SetPageCache(NewPageCache(DefaultPageCacheSize))
+
+	b.ResetTimer()
+
+	i := atomic.Int64{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pager.GetPage(i.Add(1) % 1000)
+		}
+	})
+}
+
+func BenchmarkPagerReadPages(b *testing.B) {
+	pager := benchmarkPager(b)
+	defer os.Remove("pager_benchmark.db")
+	defer pager.Close()
+
+	pageIDs := make([]int64, RUN_PAGES)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := range pageIDs {
+			pageIDs[j] = int64((i*RUN_PAGES + j) % 1000)
+		}
+
+		pager.ReadPages(pageIDs)
+	}
+}
+
+func BenchmarkPagerWriteRun(b *testing.B) {
+	pager := benchmarkPager(b)
+	defer os.Remove("pager_benchmark.db")
+	defer pager.Close()
+
+	data := make([][]byte, RUN_PAGES)
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf("page %d", i))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pager.WriteRun(data)
+	}
+}
@@ -18,17 +18,18 @@ package lsmt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestOpenPager(t *testing.T) {
 	defer os.Remove("pager.db")
-	defer os.Remove("pager.db.del")
-	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644)
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,9 +44,8 @@ func TestOpenPager(t *testing.T) {
 
 func TestPager_Write(t *testing.T) {
 	defer os.Remove("pager.db")
-	defer os.Remove("pager.db.del")
 
-	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644)
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,9 +75,8 @@ func TestPager_Write(t *testing.T) {
 
 func TestPager_Write2(t *testing.T) {
 	defer os.Remove("pager.db")
-	defer os.Remove("pager.db.del")
 
-	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644)
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -93,9 +92,8 @@ func TestPager_Write2(t *testing.T) {
 
 func TestPager_Count(t *testing.T) {
 	defer os.Remove("pager.db")
-	defer os.Remove("pager.db.del")
 
-	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644)
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,3 +116,982 @@ func TestPager_Count(t *testing.T) {
 	//	t.Fatalf("expected 1000, got %d", count)
 	//}
 }
+
+func TestPager_WriteOverflow(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	large := bytes.Repeat([]byte("0123456789"), 300) // 3 pages of 1004 bytes
+
+	largeID, err := pager.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	smallID, err := pager.Write([]byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The small page is written after the overflow pages of the large one
+	if largeID != 0 || smallID != 3 {
+		t.Fatalf("expected pages 0 and 3, got %d and %d", largeID, smallID)
+	}
+
+	data, err := pager.GetPage(largeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, large) {
+		t.Fatal("expected the large value to be read back from its overflow pages")
+	}
+
+	data, err = pager.GetPage(smallID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "Hello World" {
+		t.Fatalf("expected Hello World, got %q", data)
+	}
+
+	// Overflow pages are part of the large page
+	for _, pageID := range []int64{1, 2} {
+		data, err = pager.GetPage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if data != nil {
+			t.Fatalf("expected overflow page %d to return nil", pageID)
+		}
+	}
+}
+
+func TestPager_OverflowFreed(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat([]byte("a"), 3*(pager.PageSize()-HEADER_SIZE))
+
+	pageID, err := pager.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting the page with a small value frees its overflow pages
+	err = pager.WriteTo(pageID, []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pager.GetDeletedPages()) != 2 {
+		t.Fatalf("expected 2 deleted pages, got %v", pager.GetDeletedPages())
+	}
+
+	// The freed pages are reused before the file grows
+	pageID, err = pager.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pager.PagesCount() != 4 {
+		t.Fatalf("expected 4 pages, got %d", pager.PagesCount())
+	}
+
+	// Deleting the page frees its whole chain
+	err = pager.DeletePage(pageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pager.GetDeletedPages()) != 3 {
+		t.Fatalf("expected 3 deleted pages, got %v", pager.GetDeletedPages())
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted pages are kept when the pager is reopened
+	pager, err = OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	if len(pager.GetDeletedPages()) != 3 {
+		t.Fatalf("expected 3 deleted pages, got %v", pager.GetDeletedPages())
+	}
+
+	data, err := pager.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "small" {
+		t.Fatalf("expected small, got %q", data)
+	}
+}
+
+func TestPager_GetPageExactLength(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	// Trailing null bytes and empty data are returned as written
+	for _, data := range [][]byte{{}, []byte("data\x00\x00"), bytes.Repeat([]byte{0}, pager.PageSize()+1)} {
+		pageID, err := pager.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := pager.GetPage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Fatalf("expected %d bytes, got %d", len(data), len(got))
+		}
+	}
+}
+
+func TestPager_CorruptPage(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	_, err = pager.Write([]byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pageID, err := pager.Write(bytes.Repeat([]byte("a"), 2*(pager.PageSize()-HEADER_SIZE)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the data in the overflow page
+	_, err = pager.file.WriteAt([]byte("b"), pager.offset(pageID+1)+HEADER_SIZE+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pager.GetPage(pageID)
+
+	var corrupt *CorruptPageError
+	if !errors.As(err, &corrupt) || corrupt.PageID != pageID+1 {
+		t.Fatalf("expected page %d to be corrupt, got %v", pageID+1, err)
+	}
+
+	// Overwrite the magic number of the first page
+	_, err = pager.file.WriteAt([]byte{0, 0}, pager.offset(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pager.GetPage(0)
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("expected ErrCorruptPage, got %v", err)
+	}
+}
+
+func TestPager_PageSize(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	_, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 100)
+	if err == nil {
+		t.Fatal("expected a page size below MIN_PAGE_SIZE to be rejected")
+	}
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10000 bytes fit in a page of 16 KiB
+	data := bytes.Repeat([]byte("a"), 10000)
+
+	pageID, err := pager.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pager.PagesCount() != 1 || pager.Size() != 2*16384 {
+		t.Fatalf("expected a superblock and a page, got %d pages in %d bytes", pager.PagesCount(), pager.Size())
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The page size is validated on reopen
+	_, err = OpenPager("pager.db", os.O_RDWR, 0644, 4096)
+	if !errors.Is(err, ErrPageSizeMismatch) {
+		t.Fatalf("expected ErrPageSizeMismatch, got %v", err)
+	}
+
+	// A page size of 0 opens the file with its own page size
+	pager, err = OpenPager("pager.db", os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	if pager.PageSize() != 16384 {
+		t.Fatalf("expected a page size of 16384, got %d", pager.PageSize())
+	}
+
+	got, err := pager.GetPage(pageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("expected the page to be read back after reopening")
+	}
+}
+
+func TestPager_FreeList(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = pager.Write([]byte(fmt.Sprintf("page %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pageID := range []int64{2, 5, 7} {
+		err = pager.DeletePage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deleting a free page does nothing
+	err = pager.DeletePage(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last deleted page is the root of the free list
+	if fmt.Sprint(pager.GetDeletedPages()) != "[7 5 2]" {
+		t.Fatalf("expected deleted pages [7 5 2], got %v", pager.GetDeletedPages())
+	}
+
+	data, err := pager.GetPage(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data != nil {
+		t.Fatal("expected a free page to return nil")
+	}
+
+	// Writing to a page in the middle of the free list takes it off the list
+	err = pager.WriteTo(5, []byte("rewritten"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(pager.GetDeletedPages()) != "[7 2]" {
+		t.Fatalf("expected deleted pages [7 2], got %v", pager.GetDeletedPages())
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The free list is kept in the file
+	pager, err = OpenPager("pager.db", os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	if fmt.Sprint(pager.GetDeletedPages()) != "[7 2]" {
+		t.Fatalf("expected deleted pages [7 2] after reopening, got %v", pager.GetDeletedPages())
+	}
+
+	for _, expected := range []int64{7, 2, 10} {
+		pageID, err := pager.Write([]byte("reused"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pageID != expected {
+			t.Fatalf("expected page %d to be allocated, got %d", expected, pageID)
+		}
+	}
+
+	data, err = pager.GetPage(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "rewritten" {
+		t.Fatalf("expected rewritten, got %q", data)
+	}
+}
+
+func TestPager_OutOfRange(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	_, err = pager.Write([]byte("page 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A page which does not exist is not put on the free list
+	for _, pageID := range []int64{10, -1} {
+		err = pager.DeletePage(pageID)
+		if err == nil {
+			t.Fatalf("expected error deleting page %d", pageID)
+		}
+	}
+
+	stats := pager.Stats()
+	if stats.Pages != 1 || stats.LivePages != 1 || stats.FreePages != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	err = pager.WriteTo(-1, []byte("negative"))
+	if err == nil {
+		t.Fatal("expected error writing page -1")
+	}
+
+	// Writing past the end of the file frees the pages in between
+	err = pager.WriteTo(5, []byte("page 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pageID := int64(1); pageID < 5; pageID++ {
+		data, err := pager.GetPage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if data != nil {
+			t.Fatalf("expected page %d to be free, got %s", pageID, data)
+		}
+	}
+
+	if fmt.Sprint(pager.GetDeletedPages()) != "[1 2 3 4]" {
+		t.Fatalf("expected deleted pages [1 2 3 4], got %v", pager.GetDeletedPages())
+	}
+
+	// The free pages are reused before the file grows
+	pageID, err := pager.Write([]byte("page 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pageID != 1 {
+		t.Fatalf("expected page 1, got %d", pageID)
+	}
+
+	data, err := pager.GetPage(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "page 5" {
+		t.Fatalf("expected page 5, got %s", data)
+	}
+}
+
+func TestPager_Mmap(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small, err := pager.Write([]byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat([]byte("0123456789"), 300)
+
+	largeID, err := pager.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pager, err = OpenMappedPager("pager.db", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := pager.GetPage(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "Hello World" {
+		t.Fatalf("expected Hello World, got %q", data)
+	}
+
+	// The page is read from the memory map without a copy
+	if &data[0] != &pager.mapping[pager.offset(small)+HEADER_SIZE] {
+		t.Fatal("expected the page to be a slice of the memory map")
+	}
+
+	data, err = pager.GetPage(largeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, large) {
+		t.Fatal("expected the large value to be read back from its overflow pages")
+	}
+
+	// A memory-mapped pager is read-only
+	_, err = pager.Write([]byte("Hello World"))
+	if err == nil {
+		t.Fatal("expected writing to a memory-mapped pager to fail")
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pager.mapping != nil {
+		t.Fatal("expected the memory map to be released")
+	}
+}
+
+func TestPager_Sync(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pager.Write([]byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pager.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing twice reports the failure instead of dropping it
+	err = pager.Close()
+	if err == nil {
+		t.Fatal("expected error closing a closed pager")
+	}
+
+	pager, err = OpenPager("pager.db", os.O_RDONLY, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := pager.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "Hello World" {
+		t.Fatalf("expected Hello World, got %s", data)
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPager_Vacuum(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err = pager.Write([]byte(fmt.Sprintf("page %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The large page overflows into the pages after it
+	large := bytes.Repeat([]byte("0123456789"), 300)
+
+	largeID, err := pager.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pageID := range []int64{1, 2, 3} {
+		err = pager.DeletePage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := pager.Stats()
+	if stats.Pages != 8 || stats.LivePages != 5 || stats.FreePages != 3 || stats.Fragmentation != 3.0/8 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The pages in use move down in order, the data pages after the free pages included
+	moved, err := pager.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(moved) != "map[4:1 5:2 6:3 7:4]" {
+		t.Fatalf("expected pages 4 to 7 to move to 1 to 4, got %v", moved)
+	}
+
+	stats = pager.Stats()
+	if stats.Pages != 5 || stats.LivePages != 5 || stats.FreePages != 0 || stats.Fragmentation != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if pager.Size() != 6*1024 {
+		t.Fatalf("expected size %d, got %d", 6*1024, pager.Size())
+	}
+
+	data, err := pager.GetPage(moved[largeID])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, large) {
+		t.Fatalf("expected large page to survive the vacuum")
+	}
+
+	err = pager.DeletePage(moved[largeID])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err = pager.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(moved) != 0 {
+		t.Fatalf("expected no page to move, got %v", moved)
+	}
+
+	if pager.Size() != 3*1024 {
+		t.Fatalf("expected size %d, got %d", 3*1024, pager.Size())
+	}
+
+	// The vacuumed file replaced the old one
+	_, err = os.Stat("pager.db" + VACUUM_EXTENSION)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected the vacuum file to be gone, got %v", err)
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pager, err = OpenPager("pager.db", os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	stats = pager.Stats()
+	if stats.Pages != 2 || stats.FreePages != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	for pageID, expected := range []string{"page 0", "page 4"} {
+		data, err = pager.GetPage(int64(pageID))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != expected {
+			t.Fatalf("expected %s, got %s", expected, data)
+		}
+	}
+}
+
+func TestPager_VacuumHoles(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = pager.Write([]byte(fmt.Sprintf("page %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file grows by zeros, as after a crash while pages were allocated
+	err = os.Truncate("pager.db", 6*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pager, err = OpenPager("pager.db", os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	_, err = pager.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pager.Size() != 3*1024 {
+		t.Fatalf("expected size %d, got %d", 3*1024, pager.Size())
+	}
+
+	data, err := pager.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "page 1" {
+		t.Fatalf("expected page 1, got %s", data)
+	}
+}
+
+func TestPager_ConcurrentReads(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err = pager.Write([]byte(fmt.Sprintf("page %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+
+	// Readers share the pages while a writer rewrites them
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := int64(0); i < 1000; i++ {
+				data, err := pager.GetPage(i % 100)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if string(data) != fmt.Sprintf("page %d", i%100) && string(data) != fmt.Sprintf("rewritten %d", i%100) {
+					t.Errorf("unexpected page %d %s", i%100, data)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := int64(0); i < 100; i++ {
+		err = pager.WriteTo(i, []byte(fmt.Sprintf("rewritten %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestPager_WriteRun(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pager.Write([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The large value overflows into the two pages after it
+	large := bytes.Repeat([]byte("0123456789"), 300)
+	data := [][]byte{[]byte("Hello"), large, []byte("World"), nil}
+
+	for i := 0; i < 100; i++ {
+		data = append(data, []byte(fmt.Sprintf("value %d", i)))
+	}
+
+	pageIDs, err := pager.WriteRun(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(pageIDs[:5]) != "[1 2 5 6 7]" {
+		t.Fatalf("expected pages [1 2 5 6 7], got %v", pageIDs[:5])
+	}
+
+	if pager.PagesCount() != 107 {
+		t.Fatalf("expected 107 pages, got %d", pager.PagesCount())
+	}
+
+	// The overflow pages of the large value read as nil like with GetPage
+	pages, err := pager.ReadPages([]int64{2, 3, 4, 1, 0, 106})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(pages[0], large) || pages[1] != nil || pages[2] != nil {
+		t.Fatalf("expected the large value and its overflow pages")
+	}
+
+	if string(pages[3]) != "Hello" || string(pages[4]) != "first" || string(pages[5]) != "value 99" {
+		t.Fatalf("unexpected pages %q %q %q", pages[3], pages[4], pages[5])
+	}
+
+	for i, pageID := range pageIDs {
+		page, err := pager.GetPage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(page, data[i]) {
+			t.Fatalf("expected %q, got %q", data[i], page)
+		}
+	}
+
+	_, err = pager.ReadPages([]int64{107})
+	if err == nil {
+		t.Fatal("expected error reading past the last page")
+	}
+
+	err = pager.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages read through a memory map or the page cache are the same
+	for _, open := range []func() (*Pager, error){
+		func() (*Pager, error) { return OpenMappedPager("pager.db", 0) },
+		func() (*Pager, error) {
+			pager, err := OpenPager("pager.db", os.O_RDONLY, 0, 0)
+			if err == nil {
+				pager.SetPageCache(NewPageCache(DefaultPageCacheSize))
+			}
+			return pager, err
+		},
+	} {
+		pager, err = open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for round := 0; round < 2; round++ {
+			pages, err = pager.ReadPages(pageIDs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range pageIDs {
+				if !bytes.Equal(pages[i], data[i]) {
+					t.Fatalf("expected %q, got %q", data[i], pages[i])
+				}
+			}
+		}
+
+		err = pager.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPager_WriteToRuns(t *testing.T) {
+	defer os.Remove("pager.db")
+
+	pager, err := OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.Close()
+
+	for i := 0; i < 6; i++ {
+		_, err = pager.Write([]byte(fmt.Sprintf("page %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The free list holds pages which do not follow each other
+	for _, pageID := range []int64{4, 1, 2} {
+		err = pager.DeletePage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The value takes the free pages then a run longer than RUN_PAGES at the end of the file
+	large := make([]byte, (RUN_PAGES+20)*(pager.PageSize()-HEADER_SIZE))
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	err = pager.WriteTo(0, large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pager.PagesCount() != RUN_PAGES+22 {
+		t.Fatalf("expected %d pages, got %d", RUN_PAGES+22, pager.PagesCount())
+	}
+
+	data, err := pager.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, large) {
+		t.Fatal("expected the large value to read back")
+	}
+
+	for _, pageID := range []int64{3, 5} {
+		data, err = pager.GetPage(pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != fmt.Sprintf("page %d", pageID) {
+			t.Fatalf("expected page %d to be kept, got %q", pageID, data)
+		}
+	}
+
+	// Rewriting the page frees its whole chain
+	err = pager.WriteTo(0, []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pager.GetDeletedPages()) != RUN_PAGES+19 {
+		t.Fatalf("expected %d deleted pages, got %d", RUN_PAGES+19, len(pager.GetDeletedPages()))
+	}
+}
+
+func TestPager_LegacyFormat(t *testing.T) {
+	defer os.Remove("pager.db")
+	defer os.Remove("pager.db" + LEGACY_DELETED_PAGES_EXTENSION)
+
+	// A legacy file has 1024 byte pages after a 256 byte header holding the next page in decimal
+	legacy := make([]byte, 2*legacyPageSize)
+	copy(legacy, "1")
+	copy(legacy[legacyHeaderSize:], "Hello")
+	copy(legacy[legacyPageSize:], "-1")
+	copy(legacy[legacyPageSize+legacyHeaderSize:], "World")
+
+	err := os.WriteFile("pager.db", legacy, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenPager("pager.db", os.O_RDWR, 0644, 0)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	// A file which is neither format is corrupt
+	err = os.WriteFile("pager.db", bytes.Repeat([]byte("x"), legacyPageSize), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenPager("pager.db", os.O_RDWR, 0644, 0)
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("expected ErrCorruptPage, got %v", err)
+	}
+
+	err = os.Remove("pager.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted pages file of the legacy format is not ignored, even for a new file
+	err = os.WriteFile("pager.db"+LEGACY_DELETED_PAGES_EXTENSION, []byte("1,2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenPager("pager.db", os.O_CREATE|os.O_RDWR, 0644, 0)
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	if _, err = os.Stat("pager.db"); !os.IsNotExist(err) {
+		t.Fatal("expected no file to be created")
+	}
+}
@@ -0,0 +1,94 @@
+// Package skiplist
+// Arena allocator for the keys and values of a skiplist
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package skiplist
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const DEFAULT_CHUNK_SIZE = 1 << 20 // Size of the chunks an arena allocates from
+
+// Arena hands out byte slices from large chunks, so a skiplist does not allocate for every key and value.
+// Allocations are lock-free until a chunk is full, memory is only given back when the arena is dropped.
+type Arena struct {
+	chunkSize int                   // The size of the chunks.
+	current   atomic.Pointer[chunk] // The chunk allocations are made from.
+	lock      *sync.Mutex           // Lock for replacing the current chunk.
+	size      atomic.Int64          // The bytes allocated.
+}
+
+// chunk is a slab of memory allocations are carved from.
+type chunk struct {
+	buf    []byte       // The memory of the chunk.
+	offset atomic.Int64 // The offset of the next allocation.
+}
+
+// NewArena creates an arena allocating chunks of chunkSize bytes.
+func NewArena(chunkSize int) *Arena {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+
+	a := &Arena{chunkSize: chunkSize, lock: &sync.Mutex{}}
+	a.current.Store(&chunk{buf: make([]byte, chunkSize)})
+
+	return a
+}
+
+// Allocate returns a slice of n bytes.
+// Allocations larger than a quarter of a chunk get their own slice so they do not waste the rest of a chunk.
+func (a *Arena) Allocate(n int) []byte {
+	a.size.Add(int64(n))
+
+	if n > a.chunkSize/4 {
+		return make([]byte, n)
+	}
+
+	for {
+		c := a.current.Load()
+
+		end := c.offset.Add(int64(n))
+		if end <= int64(len(c.buf)) {
+			return c.buf[end-int64(n) : end : end]
+		}
+
+		// The chunk is full, the first goroutine to notice replaces it
+		a.lock.Lock()
+		if a.current.Load() == c {
+			a.current.Store(&chunk{buf: make([]byte, a.chunkSize)})
+		}
+		a.lock.Unlock()
+	}
+}
+
+// Copy allocates a copy of b.
+func (a *Arena) Copy(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	buf := a.Allocate(len(b))
+	copy(buf, b)
+
+	return buf
+}
+
+// Size returns the bytes allocated from the arena.
+func (a *Arena) Size() int64 {
+	return a.size.Load()
+}
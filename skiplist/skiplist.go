@@ -0,0 +1,246 @@
+// Package skiplist implements a concurrent lock-free skiplist
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package skiplist
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"sync/atomic"
+	"unsafe"
+)
+
+const MAX_HEIGHT = 16 // Maximum height of a node
+
+// SkipList is a sorted map which can be read and written by many goroutines at once without locks.
+// Nodes are linked in with compare-and-swap, keys and values are copied into an arena.
+// Deleted keys are only marked deleted, their nodes stay in the skiplist.
+type SkipList struct {
+	head    *Node                 // The sentinel node before the first key.
+	height  atomic.Int32          // The height of the tallest node.
+	length  atomic.Int64          // The number of keys which are not deleted.
+	nodes   atomic.Int64          // The memory taken by the nodes.
+	arena   *Arena                // The arena keys and values are allocated from.
+	compare func(a, b []byte) int // The function ordering the keys of the skiplist.
+}
+
+// Node represents a key in the skiplist.
+type Node struct {
+	Key   []byte                 // The key of the node.
+	value atomic.Pointer[[]byte] // The value of the node, nil once the key is deleted.
+	next  []atomic.Pointer[Node] // The next node on every level of the node.
+}
+
+// NewSkipList creates a new skiplist ordering keys with bytes.Compare.
+func NewSkipList() *SkipList {
+	return NewSkipListWithComparator(bytes.Compare)
+}
+
+// NewSkipListWithComparator creates a new skiplist ordering keys with the provided compare function.
+// compare must return a negative number, zero or a positive number when a is less than, equal to or greater than b.
+func NewSkipListWithComparator(compare func(a, b []byte) int) *SkipList {
+	s := &SkipList{
+		head:    &Node{next: make([]atomic.Pointer[Node], MAX_HEIGHT)},
+		arena:   NewArena(DEFAULT_CHUNK_SIZE),
+		compare: compare,
+	}
+
+	s.height.Store(1)
+
+	return s
+}
+
+// Value returns the value of the node, or nil if the key was deleted.
+func (n *Node) Value() []byte {
+	value := n.value.Load()
+	if value == nil {
+		return nil
+	}
+
+	return *value
+}
+
+// Deleted returns whether the key of the node was deleted.
+func (n *Node) Deleted() bool {
+	return n.value.Load() == nil
+}
+
+// Next returns the next node on the lowest level, deleted or not.
+func (n *Node) Next() *Node {
+	return n.next[0].Load()
+}
+
+// randomHeight returns the height of a new node, every level being a quarter as likely as the one below.
+func randomHeight() int {
+	height := 1
+	for height < MAX_HEIGHT && rand.Uint32()&3 == 0 {
+		height++
+	}
+
+	return height
+}
+
+// findSplice returns the nodes between which key belongs on the level, starting the search at the before node.
+// The key of before is less than key and the key of after is greater or equal to key, after being nil at the end of the level.
+func (s *SkipList) findSplice(key []byte, before *Node, level int) (*Node, *Node) {
+	for {
+		after := before.next[level].Load()
+		if after == nil || s.compare(after.Key, key) >= 0 {
+			return before, after
+		}
+
+		before = after
+	}
+}
+
+// Insert inserts a key with the given value into the skiplist, replacing the value of an existing key.
+// It returns the previous value and whether the key was in the skiplist.
+func (s *SkipList) Insert(key, value []byte) ([]byte, bool) {
+	var before, after [MAX_HEIGHT]*Node
+
+	// Find the splice of every level, from the top down
+	listHeight := int(s.height.Load())
+	prev := s.head
+	for level := listHeight - 1; level >= 0; level-- {
+		prev, after[level] = s.findSplice(key, prev, level)
+		before[level] = prev
+	}
+
+	if after[0] != nil && s.compare(after[0].Key, key) == 0 {
+		return s.replace(after[0], value)
+	}
+
+	height := randomHeight()
+	n := &Node{Key: s.arena.Copy(key), next: make([]atomic.Pointer[Node], height)}
+	v := s.arena.Copy(value)
+	n.value.Store(&v)
+
+	// Raise the height of the skiplist, the new levels start at the head
+	for {
+		current := s.height.Load()
+		if int(current) >= height || s.height.CompareAndSwap(current, int32(height)) {
+			break
+		}
+	}
+
+	for level := listHeight; level < height; level++ {
+		before[level] = s.head
+		after[level] = nil
+	}
+
+	// Link the node from the bottom up, once it is on the lowest level it is in the skiplist
+	for level := 0; level < height; level++ {
+		for {
+			n.next[level].Store(after[level])
+			if before[level].next[level].CompareAndSwap(after[level], n) {
+				break
+			}
+
+			// Another node was linked in, find the splice again
+			before[level], after[level] = s.findSplice(key, before[level], level)
+
+			if level == 0 && after[0] != nil && s.compare(after[0].Key, key) == 0 {
+				// The key was inserted by another goroutine
+				return s.replace(after[0], value)
+			}
+		}
+	}
+
+	s.length.Add(1)
+	s.nodes.Add(int64(unsafe.Sizeof(Node{})) + int64(height)*int64(unsafe.Sizeof(atomic.Pointer[Node]{})))
+
+	return nil, false
+}
+
+// replace replaces the value of the node, reviving it if it was deleted.
+func (s *SkipList) replace(n *Node, value []byte) ([]byte, bool) {
+	v := s.arena.Copy(value)
+
+	old := n.value.Swap(&v)
+	if old == nil {
+		s.length.Add(1)
+		return nil, false
+	}
+
+	return *old, true
+}
+
+// Search returns the node of the key, or nil if the key is not in the skiplist or was deleted.
+func (s *SkipList) Search(key []byte) *Node {
+	n := s.Seek(key)
+	if n == nil || s.compare(n.Key, key) != 0 || n.Deleted() {
+		return nil
+	}
+
+	return n
+}
+
+// Seek returns the first node with a key greater or equal to key, deleted or not, or nil if there is none.
+func (s *SkipList) Seek(key []byte) *Node {
+	var after *Node
+
+	prev := s.head
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		prev, after = s.findSplice(key, prev, level)
+	}
+
+	return after
+}
+
+// First returns the first node of the skiplist, deleted or not, or nil if the skiplist is empty.
+func (s *SkipList) First() *Node {
+	return s.head.next[0].Load()
+}
+
+// Delete marks the key deleted, returning its value and whether it was in the skiplist.
+func (s *SkipList) Delete(key []byte) ([]byte, bool) {
+	n := s.Seek(key)
+	if n == nil || s.compare(n.Key, key) != 0 {
+		return nil, false
+	}
+
+	old := n.value.Swap(nil)
+	if old == nil {
+		return nil, false
+	}
+
+	s.length.Add(-1)
+
+	return *old, true
+}
+
+// InOrderTraversal calls f with every key which is not deleted, in order, until f returns false.
+func (s *SkipList) InOrderTraversal(f func(key, value []byte) bool) {
+	for n := s.First(); n != nil; n = n.Next() {
+		value := n.value.Load()
+		if value == nil {
+			continue
+		}
+
+		if !f(n.Key, *value) {
+			return
+		}
+	}
+}
+
+// Len returns the number of keys in the skiplist.
+func (s *SkipList) Len() int {
+	return int(s.length.Load())
+}
+
+// Size returns the memory taken by the nodes, keys and values of the skiplist, including replaced and deleted ones.
+func (s *SkipList) Size() int64 {
+	return s.nodes.Load() + s.arena.Size()
+}
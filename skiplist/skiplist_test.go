@@ -0,0 +1,270 @@
+// Package skiplist tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package skiplist
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSkipList_InsertAndSearch(t *testing.T) {
+	s := NewSkipList()
+
+	s.Insert([]byte("key2"), []byte("value2"))
+	s.Insert([]byte("key1"), []byte("value1"))
+	s.Insert([]byte("key3"), []byte("value3"))
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		node := s.Search([]byte(key))
+		if node == nil {
+			t.Fatalf("expected to find %s", key)
+		}
+
+		if !bytes.Equal(node.Value(), []byte("value"+key[3:])) {
+			t.Fatalf("expected value%s, got %s", key[3:], node.Value())
+		}
+	}
+
+	if s.Search([]byte("key4")) != nil {
+		t.Fatal("expected key4 not to be found")
+	}
+
+	if s.Len() != 3 {
+		t.Fatalf("expected 3 keys, got %d", s.Len())
+	}
+}
+
+func TestSkipList_Replace(t *testing.T) {
+	s := NewSkipList()
+
+	_, replaced := s.Insert([]byte("key"), []byte("value1"))
+	if replaced {
+		t.Fatal("expected a new key")
+	}
+
+	old, replaced := s.Insert([]byte("key"), []byte("value2"))
+	if !replaced || string(old) != "value1" {
+		t.Fatalf("expected value1 to be replaced, got %s", old)
+	}
+
+	if string(s.Search([]byte("key")).Value()) != "value2" {
+		t.Fatal("expected value2")
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 key, got %d", s.Len())
+	}
+}
+
+func TestSkipList_CopiesKeysAndValues(t *testing.T) {
+	s := NewSkipList()
+
+	key := []byte("key")
+	value := []byte("value")
+	s.Insert(key, value)
+
+	key[0] = 'x'
+	value[0] = 'x'
+
+	node := s.Search([]byte("key"))
+	if node == nil || string(node.Value()) != "value" {
+		t.Fatal("expected the skiplist to keep its own copy of the key and value")
+	}
+}
+
+func TestSkipList_Delete(t *testing.T) {
+	s := NewSkipList()
+
+	for i := 0; i < 10; i++ {
+		s.Insert([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+
+	old, deleted := s.Delete([]byte("key5"))
+	if !deleted || string(old) != "value5" {
+		t.Fatal("expected key5 to be deleted")
+	}
+
+	if _, deleted = s.Delete([]byte("key5")); deleted {
+		t.Fatal("expected key5 to be deleted once")
+	}
+
+	if s.Search([]byte("key5")) != nil {
+		t.Fatal("expected key5 not to be found")
+	}
+
+	if s.Len() != 9 {
+		t.Fatalf("expected 9 keys, got %d", s.Len())
+	}
+
+	// Inserting a deleted key revives it
+	if _, replaced := s.Insert([]byte("key5"), []byte("value")); replaced {
+		t.Fatal("expected key5 to be a new key")
+	}
+
+	if s.Len() != 10 {
+		t.Fatalf("expected 10 keys, got %d", s.Len())
+	}
+}
+
+func TestSkipList_InOrderTraversal(t *testing.T) {
+	s := NewSkipList()
+
+	for i := 99; i >= 0; i-- {
+		s.Insert([]byte(fmt.Sprintf("%03d", i)), []byte("value"))
+	}
+
+	s.Delete([]byte("050"))
+
+	var keys []string
+	s.InOrderTraversal(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if len(keys) != 99 {
+		t.Fatalf("expected 99 keys, got %d", len(keys))
+	}
+
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("expected %s before %s", keys[i-1], keys[i])
+		}
+	}
+
+	// Stop early
+	count := 0
+	s.InOrderTraversal(func(key, value []byte) bool {
+		count++
+		return count < 10
+	})
+
+	if count != 10 {
+		t.Fatalf("expected to stop after 10 keys, got %d", count)
+	}
+}
+
+func TestSkipList_Seek(t *testing.T) {
+	s := NewSkipList()
+
+	for i := 0; i < 100; i += 10 {
+		s.Insert([]byte(fmt.Sprintf("%03d", i)), []byte("value"))
+	}
+
+	node := s.Seek([]byte("015"))
+	if node == nil || string(node.Key) != "020" {
+		t.Fatal("expected to seek to 020")
+	}
+
+	node = s.Seek([]byte("020"))
+	if node == nil || string(node.Key) != "020" {
+		t.Fatal("expected to seek to 020")
+	}
+
+	if s.Seek([]byte("091")) != nil {
+		t.Fatal("expected nothing after 090")
+	}
+}
+
+func TestSkipList_Comparator(t *testing.T) {
+	s := NewSkipListWithComparator(func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	})
+
+	for _, key := range []string{"b", "d", "a", "c"} {
+		s.Insert([]byte(key), []byte(key))
+	}
+
+	var keys []string
+	s.InOrderTraversal(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	expected := []string{"d", "c", "b", "a"}
+	for i, key := range keys {
+		if key != expected[i] {
+			t.Fatalf("expected %s at %d, got %s", expected[i], i, key)
+		}
+	}
+}
+
+func TestSkipList_Concurrent(t *testing.T) {
+	s := NewSkipList()
+
+	wg := &sync.WaitGroup{}
+
+	// Writers overlap on half of their keys
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.Insert([]byte(fmt.Sprintf("%05d", (w%2)*1000+i)), []byte(fmt.Sprintf("%d", w)))
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	if s.Len() != 2000 {
+		t.Fatalf("expected 2000 keys, got %d", s.Len())
+	}
+
+	count := 0
+	var last []byte
+	s.InOrderTraversal(func(key, value []byte) bool {
+		if last != nil && bytes.Compare(last, key) >= 0 {
+			t.Fatalf("expected %s before %s", last, key)
+		}
+
+		last = key
+		count++
+		return true
+	})
+
+	if count != 2000 {
+		t.Fatalf("expected 2000 keys, got %d", count)
+	}
+}
+
+func TestArena_Allocate(t *testing.T) {
+	a := NewArena(64)
+
+	first := a.Allocate(10)
+	second := a.Allocate(10)
+
+	if len(first) != 10 || cap(first) != 10 {
+		t.Fatal("expected the allocation to be capped at its length")
+	}
+
+	first[9] = 1
+	if second[0] != 0 {
+		t.Fatal("expected allocations not to overlap")
+	}
+
+	// Larger than a quarter of a chunk, and enough to fill the chunk
+	for i := 0; i < 10; i++ {
+		a.Allocate(16)
+	}
+
+	a.Allocate(100)
+
+	if a.Size() != 10+10+160+100 {
+		t.Fatalf("expected 280 bytes allocated, got %d", a.Size())
+	}
+}
@@ -0,0 +1,254 @@
+// Package lsmt
+// Pager vacuum, giving the space of free pages back to the file system
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lsmt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const VACUUM_EXTENSION = ".vacuum" // The file a pager is rewritten to before it replaces the pager's file
+
+// Vacuum gives the space of free pages back to the file system, returning the new ID of every page which moved
+// The pages in use are rewritten to a new file in the order of their IDs, so pages read in order stay in order, and the chains are relinked to the new IDs
+// The new file replaces the old one once it is synced, a crash leaves one or the other whole
+// Pages which no data page links to are free, this reclaims pages a crash left off the free list
+func (p *Pager) Vacuum() (map[int64]int64, error) {
+	if !p.writable || p.mapping != nil {
+		return nil, errors.New("pager is read-only")
+	}
+
+	p.vacuumLock.Lock()
+	defer p.vacuumLock.Unlock()
+
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	pages := p.pages.Load()
+
+	headers := make([]pageHeader, pages)
+	for pageID := range headers {
+		data, err := p.readAt(HEADER_SIZE, p.offset(int64(pageID)))
+		if err == io.EOF || (err == nil && bytes.Count(data, []byte{0}) == len(data)) {
+			// the page was allocated but never written, or is a hole of zeros
+			headers[pageID] = pageHeader{pageType: PAGE_TYPE_FREE, next: -1}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		headers[pageID], err = decodePageHeader(int64(pageID), p.pageSize, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// follow the chain of every data page to find the pages in use
+	live := make([]bool, pages)
+
+	for pageID, header := range headers {
+		if header.pageType != PAGE_TYPE_DATA {
+			continue
+		}
+
+		live[pageID] = true
+
+		for id := int64(pageID); headers[id].next != -1; {
+			next := headers[id].next
+			if next < 0 || next >= pages || headers[next].pageType != PAGE_TYPE_OVERFLOW || live[next] {
+				return nil, &CorruptPageError{PageID: id, Reason: "page chain links to a page which is not an overflow page of its own"}
+			}
+
+			live[next] = true
+			id = next
+		}
+	}
+
+	// the pages in use are numbered in the order of their IDs
+	newIDs := make([]int64, pages)
+	moved := make(map[int64]int64)
+	count := int64(0)
+
+	for pageID := int64(0); pageID < pages; pageID++ {
+		if !live[pageID] {
+			continue
+		}
+
+		newIDs[pageID] = count
+		if pageID != count {
+			moved[pageID] = count
+		}
+
+		count++
+	}
+
+	if count == pages && p.freePages == 0 {
+		return moved, nil
+	}
+
+	stat, err := p.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := p.file.Name()
+
+	file, err := os.OpenFile(fileName+VACUUM_EXTENSION, os.O_CREATE|os.O_TRUNC|os.O_RDWR, stat.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.rewrite(file, headers, live, newIDs)
+	if err != nil {
+		file.Close()
+		os.Remove(fileName + VACUUM_EXTENSION)
+		return nil, err
+	}
+
+	err = os.Rename(fileName+VACUUM_EXTENSION, fileName)
+	if err != nil {
+		file.Close()
+		os.Remove(fileName + VACUUM_EXTENSION)
+		return nil, err
+	}
+
+	err = syncDirectory(filepath.Dir(fileName))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// the new file is reopened under the name of the old one, which the pager reads and writes from here on
+	err = file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err = os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	old := p.file
+	p.file = file
+	p.pages.Store(count)
+	p.freeListRoot, p.freePages = -1, 0
+
+	if p.cache != nil {
+		p.cache.invalidateFile(p.cacheFile)
+	}
+
+	p.StatLock.Lock()
+	p.cachedCount = 0
+	p.StatLock.Unlock()
+
+	return moved, old.Close()
+}
+
+// rewrite writes the superblock and the pages in use to a file under their new IDs, syncing it
+func (p *Pager) rewrite(file *os.File, headers []pageHeader, live []bool, newIDs []int64) error {
+	buf := make([]byte, p.pageSize, RUN_PAGES*p.pageSize)
+	copy(buf, encodeSuperblock(superblock{pageSize: p.pageSize, freeListRoot: -1}))
+
+	offset := int64(0)
+
+	for pageID := range headers {
+		if !live[pageID] {
+			continue
+		}
+
+		page, err := p.readAt(p.pageSize, p.offset(int64(pageID)))
+		if err != nil {
+			return err
+		}
+
+		header, data, err := decodePage(int64(pageID), page)
+		if err != nil {
+			return err
+		}
+
+		next := header.next
+		if next != -1 {
+			next = newIDs[next]
+		}
+
+		buf = append(buf, encodePage(p.pageSize, header.pageType, next, data)...)
+
+		if len(buf) == cap(buf) {
+			_, err = file.WriteAt(buf, offset)
+			if err != nil {
+				return err
+			}
+
+			offset += int64(len(buf))
+			buf = buf[:0]
+		}
+	}
+
+	_, err := file.WriteAt(buf, offset)
+	if err != nil {
+		return err
+	}
+
+	return fdatasync(file)
+}
+
+// Truncate removes every page, leaving the file with its superblock
+func (p *Pager) Truncate() error {
+	if !p.writable || p.mapping != nil {
+		return errors.New("pager is read-only")
+	}
+
+	p.vacuumLock.Lock()
+	defer p.vacuumLock.Unlock()
+
+	p.freeListLock.Lock()
+	defer p.freeListLock.Unlock()
+
+	// the free list is emptied before the pages it links are cut off
+	p.freeListRoot, p.freePages = -1, 0
+
+	err := p.writeSuperblock()
+	if err != nil {
+		return err
+	}
+
+	err = fdatasync(p.file)
+	if err != nil {
+		return err
+	}
+
+	err = p.file.Truncate(p.pageSize)
+	if err != nil {
+		return err
+	}
+
+	p.pages.Store(0)
+
+	if p.cache != nil {
+		p.cache.invalidateFile(p.cacheFile)
+	}
+
+	p.StatLock.Lock()
+	p.cachedCount = 0
+	p.StatLock.Unlock()
+
+	return fdatasync(p.file)
+}